@@ -1,10 +1,23 @@
 package main
 
 import (
+	"errors"
+	"math"
+	"sync"
+
 	as "github.com/aerospike/aerospike-client-go"
 	ase "github.com/aerospike/aerospike-client-go/types"
 )
 
+// Special Aerospike TTLs: the record never expires, and the write does not
+// change the TTL of the record (needs Aerospike 3.10.1)
+const ttlNeverExpire = math.MaxUint32
+const ttlDontUpdate = math.MaxUint32 - 1
+
+// Max TTL of a record, in seconds: the server refuses TTLs above its
+// max-ttl, 10 years
+const maxTTL = 315360000
+
 func fillReadPolicy(readPolicy *as.BasePolicy) {
 	readPolicy.ConsistencyLevel = as.CONSISTENCY_ONE
 	readPolicy.ReplicaPolicy = as.MASTER_PROLES
@@ -15,17 +28,96 @@ func fillWritePolicy(writePolicy *as.WritePolicy) {
 }
 
 func fillWritePolicyEx(ctx *context, ttl int, createOnly bool) *as.WritePolicy {
+	if createOnly {
+		return fillWritePolicyAction(ctx, ttl, as.CREATE_ONLY)
+	}
+	return fillWritePolicyAction(ctx, ttl, as.UPDATE)
+}
+
+func fillWritePolicyAction(ctx *context, ttl int, action as.RecordExistsAction) *as.WritePolicy {
 	policy := as.NewWritePolicy(0, 0)
 	if ttl != -1 {
 		policy = as.NewWritePolicy(0, uint32(ttl))
 	}
 	fillWritePolicy(policy)
-	if createOnly {
-		policy.RecordExistsAction = as.CREATE_ONLY
+	policy.RecordExistsAction = action
+	policy.SendKey = ctx.sendKey
+	return policy
+}
+
+// setSendKey makes the writes of ctx store the user key of the records, so
+// scans return it
+func setSendKey(ctx *context) {
+	ctx.sendKey = true
+	policy := *ctx.writePolicy
+	policy.SendKey = true
+	ctx.writePolicy = &policy
+}
+
+// Max number of read / modify / write cycles guarded by the record generation
+const casMaxAttempts = 10
+
+// errTooManyModifications is returned by casRetry after casMaxAttempts
+// cycles: it is sent as an error reply, and the connection is kept
+var errTooManyModifications = errors.New("ERR too many concurrent modifications of the key, try again")
+
+// fillWritePolicyCas returns a policy which only applies if the record has not
+// been modified since it was read as rec. A nil rec means the record did not exist.
+func fillWritePolicyCas(ctx *context, ttl int, rec *as.Record) *as.WritePolicy {
+	if rec == nil {
+		return fillWritePolicyAction(ctx, ttl, as.CREATE_ONLY)
 	}
+	policy := fillWritePolicyAction(ctx, ttl, as.UPDATE)
+	policy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+	policy.Generation = rec.Generation
 	return policy
 }
 
+// casRetry runs f until it does not fail because the record was modified concurrently
+func casRetry(f func() error) error {
+	for i := 0; i < casMaxAttempts; i++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		code := errResultCode(err)
+		if code != ase.GENERATION_ERROR && code != ase.KEY_EXISTS_ERROR {
+			return err
+		}
+	}
+	return errTooManyModifications
+}
+
+// forEachBounded calls f for each i in [0, n), running at most limit calls
+// at the same time. Returns the first error, no call is started after it.
+func forEachBounded(n int, limit int, f func(i int) error) error {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		if len(errs) > 0 {
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := f(i)
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
 func buildKey(ctx *context, key []byte) (*as.Key, error) {
 	return as.NewKey(ctx.ns, ctx.set, string(key))
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// Blocking list pops.
+// A blocked client is woken up as soon as a push is done through this
+// instance on one of the keys it waits for. Pushes done through other
+// instances are seen by polling, with a backoff growing from
+// blockingPollMin to blockingPollMax. No Aerospike connection is held
+// between two attempts. A client which disconnects while blocked stops the
+// polling. Inside MULTI, the commands do not block, as in Redis.
+
+type listWaiters struct {
+	sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+func newListWaiters() *listWaiters {
+	return &listWaiters{waiters: make(map[string]map[chan struct{}]bool)}
+}
+
+func (w *listWaiters) register(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	w.Lock()
+	defer w.Unlock()
+	for _, k := range keys {
+		if w.waiters[k] == nil {
+			w.waiters[k] = make(map[chan struct{}]bool)
+		}
+		w.waiters[k][ch] = true
+	}
+	return ch
+}
+
+func (w *listWaiters) unregister(keys []string, ch chan struct{}) {
+	w.Lock()
+	defer w.Unlock()
+	for _, k := range keys {
+		delete(w.waiters[k], ch)
+		if len(w.waiters[k]) == 0 {
+			delete(w.waiters, k)
+		}
+	}
+}
+
+func (w *listWaiters) notify(key string) {
+	w.Lock()
+	defer w.Unlock()
+	for ch := range w.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// clientWatcher is implemented by the writers of client connections
+type clientWatcher interface {
+	// watch returns a channel closed if the client disconnects, and a
+	// function stopping the watch, to call before reading the next command.
+	// ok is false if the writer does not send to a client.
+	watch() (gone <-chan struct{}, stop func(), ok bool)
+}
+
+// clientConn is the writer given to the handlers of a connection
+type clientConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *clientConn) watch() (<-chan struct{}, func(), bool) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the handler does not read, the next command stays buffered
+		_, err := c.reader.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			close(gone)
+		}
+	}()
+	return gone, func() {
+		c.Conn.SetReadDeadline(time.Now())
+		<-done
+		c.Conn.SetReadDeadline(time.Time{})
+	}, true
+}
+
+func parseBlockingTimeout(b []byte) (time.Duration, bool) {
+	timeout, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || timeout < 0 {
+		return 0, false
+	}
+	return time.Duration(timeout * float64(time.Second)), true
+}
+
+// blockingPop calls pop on each key until one returns an element, until
+// the timeout expires, or until the client disconnects. A zero timeout
+// blocks forever. Returns the index of the key and the element, or -1 on
+// timeout. If wf is not a client connection (inside MULTI), the keys are
+// only tried once.
+func blockingPop(wf io.Writer, ctx *context, keys [][]byte, timeout time.Duration, pop func(k []byte) (interface{}, error)) (int, interface{}, error) {
+	var gone <-chan struct{}
+	var stop func()
+	watcher, ok := wf.(clientWatcher)
+	if ok {
+		gone, stop, ok = watcher.watch()
+	}
+	if !ok {
+		for i, k := range keys {
+			x, err := pop(k)
+			if err != nil {
+				return -1, nil, err
+			}
+			if x != nil {
+				return i, x, nil
+			}
+		}
+		return -1, nil, nil
+	}
+	defer stop()
+
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = string(k)
+	}
+	// register before the first attempt, to not miss a push
+	ch := ctx.listWaiters.register(names)
+	defer ctx.listWaiters.unregister(names, ch)
+
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	backoff := ctx.blockingPollMin
+	for {
+		for i, k := range keys {
+			x, err := pop(k)
+			if err != nil {
+				return -1, nil, err
+			}
+			if x != nil {
+				return i, x, nil
+			}
+		}
+		poll := time.NewTimer(backoff)
+		select {
+		case <-ch:
+			backoff = ctx.blockingPollMin
+		case <-poll.C:
+			backoff *= 2
+			if backoff > ctx.blockingPollMax {
+				backoff = ctx.blockingPollMax
+			}
+		case <-deadline:
+			poll.Stop()
+			return -1, nil, nil
+		case <-gone:
+			poll.Stop()
+			return -1, nil, nil
+		}
+		poll.Stop()
+	}
+}
+
+// pushBack gives back an element which could not be sent to the client
+func pushBack(ctx *context, k []byte, left bool, x interface{}) {
+	key, err := buildKey(ctx, k)
+	if err == nil {
+		_, err = ctx.client.Operate(ctx.writePolicy, key, listPushOp(left, []interface{}{x}), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	}
+	if err != nil {
+		log.Printf("%s: unable to push back element to %s: %s", ctx.set, string(k), err)
+		return
+	}
+	ctx.listWaiters.notify(string(k))
+}
+
+func blockingArrayPop(wf io.Writer, ctx *context, args [][]byte, left bool) error {
+	timeout, ok := parseBlockingTimeout(args[len(args)-1])
+	if !ok {
+		return writeErrorReply(wf, "ERR timeout is not a float or out of range")
+	}
+	keys := args[:len(args)-1]
+	i, x, err := blockingPop(wf, ctx, keys, timeout, func(k []byte) (interface{}, error) {
+		key, err := buildKey(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		a, err := listPopRange(ctx, key, left, 1)
+		if err != nil || len(a) == 0 {
+			return nil, err
+		}
+		return a[0], nil
+	})
+	if err != nil {
+		return err
+	}
+	if i == -1 {
+		return writeLine(wf, "*-1")
+	}
+	err = writeLine(wf, "*2")
+	if err == nil {
+		err = writeByteArray(wf, keys[i])
+	}
+	if err == nil {
+		err = writeValue(wf, x)
+	}
+	if err != nil {
+		// the client is gone
+		pushBack(ctx, keys[i], left, x)
+	}
+	return err
+}
+
+func cmdBLPOP(wf io.Writer, ctx *context, args [][]byte) error {
+	return blockingArrayPop(wf, ctx, args, true)
+}
+
+func cmdBRPOP(wf io.Writer, ctx *context, args [][]byte) error {
+	return blockingArrayPop(wf, ctx, args, false)
+}
+
+func blockingListMove(wf io.Writer, ctx *context, src []byte, dst []byte, fromLeft bool, toLeft bool, timeout time.Duration) error {
+	i, x, err := blockingPop(wf, ctx, [][]byte{src}, timeout, func(k []byte) (interface{}, error) {
+		return listMove(ctx, k, dst, fromLeft, toLeft)
+	})
+	if err != nil {
+		return err
+	}
+	if i == -1 {
+		return writeLine(wf, "*-1")
+	}
+	return writeValue(wf, x)
+}
+
+func cmdBLMOVE(wf io.Writer, ctx *context, args [][]byte) error {
+	fromLeft, ok := parseListSide(args[2])
+	if !ok {
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	toLeft, ok := parseListSide(args[3])
+	if !ok {
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	timeout, ok := parseBlockingTimeout(args[4])
+	if !ok {
+		return writeErrorReply(wf, "ERR timeout is not a float or out of range")
+	}
+	return blockingListMove(wf, ctx, args[0], args[1], fromLeft, toLeft, timeout)
+}
+
+func cmdBRPOPLPUSH(wf io.Writer, ctx *context, args [][]byte) error {
+	timeout, ok := parseBlockingTimeout(args[2])
+	if !ok {
+		return writeErrorReply(wf, "ERR timeout is not a float or out of range")
+	}
+	return blockingListMove(wf, ctx, args[0], args[1], false, true, timeout)
+}
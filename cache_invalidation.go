@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// Expanded map cache consistency.
+// The cache maps the key of a map to its suffixed key. Writes read the
+// suffixed key of the main record on cache hits, and only use the cached one
+// if it is the same, so they never use a suffixed key which has been deleted,
+// even if the map has been recreated since. Instances also send the keys of the maps they create or
+// delete to their peers over UDP, which remove them from their cache, so
+// reads see a recreated map before the end of cache_ttl.
+
+type cacheInvalidation struct {
+	Set string `json:"set"`
+	Op  string `json:"op"`
+	Key string `json:"key"`
+}
+
+func cacheSet(ctx *context, k string, suffixedKey string) {
+	if ctx.expandedMapCache == nil {
+		return
+	}
+	ctx.expandedMapCache.cache.Set([]byte(k), []byte(suffixedKey), ctx.expandedMapCache.ttl)
+}
+
+// cacheSetMissing caches that the map k does not exist, if negative caching
+// is enabled
+func cacheSetMissing(ctx *context, k string) {
+	if ctx.expandedMapCache == nil {
+		return
+	}
+	if ctx.expandedMapCache.negativeTTL <= 0 {
+		cacheDel(ctx, k)
+		return
+	}
+	ctx.expandedMapCache.cache.Set([]byte(k), []byte{}, ctx.expandedMapCache.negativeTTL)
+}
+
+// cacheGet returns the suffixed key of the map k, if it is in the cache. The
+// suffixed key is empty if the map does not exist.
+func cacheGet(ctx *context, k string) (string, bool) {
+	c := ctx.expandedMapCache
+	if c == nil {
+		return "", false
+	}
+	v, err := c.cache.Get([]byte(k))
+	if err != nil {
+		atomic.AddUint32(&c.misses, 1)
+		return "", false
+	}
+	if len(v) == 0 {
+		atomic.AddUint32(&c.negativeHits, 1)
+	} else {
+		atomic.AddUint32(&c.hits, 1)
+	}
+	return string(v), true
+}
+
+func cacheDel(ctx *context, k string) {
+	if ctx.expandedMapCache != nil {
+		ctx.expandedMapCache.cache.Del([]byte(k))
+	}
+}
+
+// cacheNotifyPeers asks the peers to remove the map k from their cache
+func cacheNotifyPeers(ctx *context, op string, k string) {
+	if len(ctx.cachePeers) == 0 {
+		return
+	}
+	v, err := json.Marshal(cacheInvalidation{Set: ctx.set, Op: op, Key: k})
+	if err != nil {
+		log.Printf("%s: unable to encode cache invalidation: %s", ctx.set, err)
+		return
+	}
+	for _, conn := range ctx.cachePeers {
+		udpSend(conn, string(v))
+	}
+}
+
+func openCachePeers(targets []interface{}) []*net.UDPConn {
+	conns := make([]*net.UDPConn, 0, len(targets))
+	for _, t := range targets {
+		ra, err := net.ResolveUDPAddr("udp", t.(string))
+		if err != nil {
+			panic(err)
+		}
+		conn, err := net.DialUDP("udp", nil, ra)
+		if err != nil {
+			panic(err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// listenCacheInvalidations removes from the cache the maps sent by peers
+func listenCacheInvalidations(ctx *context, listen string) {
+	la, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		panic(err)
+	}
+	conn, err := net.ListenUDP("udp", la)
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("%s: Listening for cache invalidations on %s", ctx.set, listen)
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("%s: unable to read cache invalidation: %s", ctx.set, err)
+			continue
+		}
+		var m cacheInvalidation
+		err = json.Unmarshal(buf[:n], &m)
+		if err != nil {
+			log.Printf("%s: invalid cache invalidation: %s", ctx.set, err)
+			continue
+		}
+		if m.Set == ctx.set {
+			cacheDel(ctx, m.Key)
+		}
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"io"
+	"math"
+	"strconv"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// CDT map implementation: each Redis map is stored in a single Aerospike
+// map bin, keyed by field. Field names are not limited, and each command is
+// applied to a single record.
+
+const cdtMapBinName = "h"
+
+var cdtMapPolicy = as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+
+// cdtMapNotFound returns true if the error means the map does not exist
+func cdtMapNotFound(err error) bool {
+	code := errResultCode(err)
+	return code == ase.KEY_NOT_FOUND_ERROR || code == ase.BIN_NOT_FOUND
+}
+
+// cdtMapRead applies read operations to the map. Returns a nil record if the
+// map does not exist.
+func cdtMapRead(ctx *context, key *as.Key, ops ...*as.Operation) (*as.Record, error) {
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, ops...)
+	if err != nil {
+		if cdtMapNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return rec, nil
+}
+
+// cdtMapGetAll reads the whole map, and returns its live fields sorted by
+// name
+func cdtMapGetAll(ctx *context, key *as.Key) (*as.Record, []string, map[string]interface{}, error) {
+	rec, err := ctx.client.Get(ctx.readPolicy, key, cdtMapBinName, FIELD_EXPIRATIONS_BIN_NAME)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	values := make(map[string]interface{})
+	if rec != nil {
+		m, _ := rec.Bins[cdtMapBinName].(map[interface{}]interface{})
+		for k, v := range m {
+			if field, ok := k.(string); ok {
+				values[field] = v
+			}
+		}
+		removeExpiredFields(values, fieldExpirations(rec))
+	}
+	return rec, sortedFields(values), values, nil
+}
+
+func cdtMapGetField(ctx *context, k []byte, field string) (interface{}, error) {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := cdtMapRead(ctx, key, as.MapGetByKeyOp(cdtMapBinName, field, as.MapReturnType.VALUE), as.GetOpForBin(FIELD_EXPIRATIONS_BIN_NAME))
+	if err != nil || rec == nil {
+		return nil, err
+	}
+	if fieldExpired(fieldExpirations(rec), field, nowMillis()) {
+		return nil, nil
+	}
+	return rec.Bins[cdtMapBinName], nil
+}
+
+// cdtMapPut stores the items, and returns the number of created fields: the
+// size of the map is read before and after the put in the same operation.
+// If the record does not exist, the size is read then the map created at the
+// same generation.
+func cdtMapPut(ctx *context, key *as.Key, items map[interface{}]interface{}, ttl int) (int, error) {
+	// the sizes before and after the put, in a single transaction
+	res, err := ctx.client.Operate(fillWritePolicyEx(ctx, ttl, false), key, as.MapSizeOp(cdtMapBinName), as.MapPutItemsOp(cdtMapPolicy, cdtMapBinName, items), as.MapSizeOp(cdtMapBinName))
+	if err == nil {
+		// without map, the first size is nil, or not returned
+		size, newSize := 0, 0
+		switch sizes := res.Bins[cdtMapBinName].(type) {
+		case []interface{}:
+			if len(sizes) == 3 {
+				size, _ = sizes[0].(int)
+			}
+			if len(sizes) > 0 {
+				newSize, _ = sizes[len(sizes)-1].(int)
+			}
+		case int:
+			newSize = sizes
+		}
+		return newSize - size, nil
+	}
+	if !cdtMapNotFound(err) {
+		return 0, err
+	}
+	// the map does not exist yet: it is created, unless it has been in the
+	// meantime
+	created := 0
+	err = casRetry(func() error {
+		rec, err := cdtMapRead(ctx, key, as.MapSizeOp(cdtMapBinName))
+		if err != nil {
+			return err
+		}
+		size := 0
+		if rec != nil {
+			size, _ = rec.Bins[cdtMapBinName].(int)
+		}
+		res, err := ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, as.MapPutItemsOp(cdtMapPolicy, cdtMapBinName, items))
+		if err != nil {
+			return err
+		}
+		newSize, _ := res.Bins[cdtMapBinName].(int)
+		created = newSize - size
+		return nil
+	})
+	return created, err
+}
+
+// cdtMapDeleteIfEmpty removes the record once its map is empty, like Redis
+// removes empty hashes
+func cdtMapDeleteIfEmpty(ctx *context, key *as.Key) error {
+	return casRetry(func() error {
+		rec, err := cdtMapRead(ctx, key, as.MapSizeOp(cdtMapBinName))
+		if err != nil || rec == nil {
+			return err
+		}
+		if size, _ := rec.Bins[cdtMapBinName].(int); size > 0 {
+			return nil
+		}
+		_, err = ctx.client.Delete(fillWritePolicyCas(ctx, -1, rec), key)
+		return err
+	})
+}
+
+// cdtMapUpdate applies f to the current values of the fields, and stores the
+// result if the map has not been modified in the meantime. f returns the
+// new values, or an error reply.
+func cdtMapUpdate(ctx *context, key *as.Key, fields []string, ttl int, f func(values []interface{}) ([]interface{}, string)) ([]interface{}, string, error) {
+	var result []interface{}
+	reply := ""
+	err := casRetry(func() error {
+		rec, _, values, err := cdtMapGetAll(ctx, key)
+		if err != nil {
+			return err
+		}
+		current := make([]interface{}, len(fields))
+		for i, field := range fields {
+			current[i] = values[field]
+		}
+		result, reply = f(current)
+		if reply != "" {
+			return nil
+		}
+		items := make(map[interface{}]interface{})
+		for i, field := range fields {
+			items[field] = result[i]
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, as.MapPutItemsOp(cdtMapPolicy, cdtMapBinName, items))
+		return err
+	})
+	return result, reply, err
+}
+
+// cdtMapIncrBy adds incrs to integer fields. A field holding a string which
+// is an integer is converted to an integer. Fields are modified only if no
+// increment fails. A single field uses the native map increment, which is
+// reverted if it overflows, as Aerospike wraps around.
+func cdtMapIncrBy(ctx *context, key *as.Key, fields []string, incrs []int64, ttl int) ([]int64, string, error) {
+	if len(fields) == 1 {
+		// fast path: native increment
+		policy := fillWritePolicyEx(ctx, ttl, false)
+		rec, err := ctx.client.Operate(policy, key, as.MapIncrementOp(cdtMapPolicy, cdtMapBinName, fields[0], incrs[0]))
+		if err == nil {
+			result, ok := rec.Bins[cdtMapBinName].(int)
+			reply := ""
+			if !ok {
+				// a float field
+				reply = errNotInteger
+			} else if addOverflows(int64(result), incrs[0]) {
+				reply = errOverflow
+			}
+			if reply != "" {
+				_, err = ctx.client.Operate(fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY), key, as.MapIncrementOp(cdtMapPolicy, cdtMapBinName, fields[0], -incrs[0]))
+				return nil, reply, err
+			}
+			return []int64{int64(result)}, "", nil
+		}
+		code := errResultCode(err)
+		if code != ase.BIN_TYPE_ERROR && code != ase.PARAMETER_ERROR {
+			return nil, "", err
+		}
+		// a string field
+	}
+	results := make([]int64, len(fields))
+	_, reply, err := cdtMapUpdate(ctx, key, fields, ttl, func(values []interface{}) ([]interface{}, string) {
+		out := make([]interface{}, len(values))
+		for i, x := range values {
+			v, ok := parseIntValue(x)
+			if !ok {
+				return nil, errNotInteger
+			}
+			results[i] = v + incrs[i]
+			if addOverflows(results[i], incrs[i]) {
+				return nil, errOverflow
+			}
+			out[i] = results[i]
+		}
+		return out, ""
+	})
+	return results, reply, err
+}
+
+// cdtMapIncrByFloat adds incr to a field, stored as a float. Aerospike does
+// not convert integers to floats, so the new value is computed here.
+func cdtMapIncrByFloat(ctx *context, key *as.Key, field string, incr float64) (float64, string, error) {
+	var result float64
+	_, reply, err := cdtMapUpdate(ctx, key, []string{field}, -1, func(values []interface{}) ([]interface{}, string) {
+		f, ok := parseFloatValue(values[0])
+		if !ok {
+			return nil, "ERR value is not a valid float"
+		}
+		result = f + incr
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, "ERR increment would produce NaN or Infinity"
+		}
+		return []interface{}{result}, ""
+	})
+	return result, reply, err
+}
+
+func cmdCdtMapHGET(wf io.Writer, ctx *context, args [][]byte) error {
+	x, err := cdtMapGetField(ctx, args[0], string(args[1]))
+	if err != nil {
+		return err
+	}
+	if x == nil {
+		return writeLine(wf, "$-1")
+	}
+	return writeValue(wf, x)
+}
+
+func cmdCdtMapHSET(wf io.Writer, ctx *context, args [][]byte) error {
+	if len(args)%2 != 1 {
+		return writeErrorReply(wf, "ERR wrong number of arguments for 'hset' command")
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = purgeFields(ctx, key, true, true, pairFields(args[1:])...)
+	if err != nil {
+		return err
+	}
+	items := make(map[interface{}]interface{})
+	for i := 1; i+1 < len(args); i += 2 {
+		items[string(args[i])] = encode(ctx, args[i+1])
+	}
+	created, err := cdtMapPut(ctx, key, items, -1)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(created))
+}
+
+func cmdCdtMapHMSET(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = purgeFields(ctx, key, true, true, pairFields(args[1:])...)
+	if err != nil {
+		return err
+	}
+	items := make(map[interface{}]interface{})
+	for i := 1; i+1 < len(args); i += 2 {
+		items[string(args[i])] = encode(ctx, args[i+1])
+	}
+	_, err = ctx.client.Operate(ctx.writePolicy, key, as.MapPutItemsOp(cdtMapPolicy, cdtMapBinName, items))
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, "+OK")
+}
+
+func cmdCdtMapHSETNX(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	field := string(args[1])
+	err = purgeFields(ctx, key, true, false, field)
+	if err != nil {
+		return err
+	}
+	created := false
+	err = casRetry(func() error {
+		rec, err := cdtMapRead(ctx, key, as.MapGetByKeyOp(cdtMapBinName, field, as.MapReturnType.VALUE))
+		if err != nil {
+			return err
+		}
+		created = rec == nil || rec.Bins[cdtMapBinName] == nil
+		if !created {
+			return nil
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, -1, rec), key, as.MapPutOp(cdtMapPolicy, cdtMapBinName, field, encode(ctx, args[2])))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, created)
+}
+
+func cmdCdtMapHDEL(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(args)-1)
+	fields := make([]interface{}, len(args)-1)
+	for i, f := range args[1:] {
+		names[i] = string(f)
+		fields[i] = string(f)
+	}
+	err = purgeFields(ctx, key, true, true, names...)
+	if err != nil {
+		return err
+	}
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, as.MapRemoveByKeyListOp(cdtMapBinName, fields, as.MapReturnType.COUNT))
+	if err != nil {
+		if cdtMapNotFound(err) {
+			return writeLine(wf, ":0")
+		}
+		return err
+	}
+	removed, _ := rec.Bins[cdtMapBinName].(int)
+	if removed > 0 {
+		err = cdtMapDeleteIfEmpty(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	return writeLine(wf, ":"+strconv.Itoa(removed))
+}
+
+func cmdCdtMapHMGET(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, _, values, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = writeLine(wf, "*"+strconv.Itoa(len(args)-1))
+	if err != nil {
+		return err
+	}
+	for _, f := range args[1:] {
+		x := values[string(f)]
+		if x == nil {
+			err = writeLine(wf, "$-1")
+		} else {
+			err = writeValue(wf, x)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdCdtMapHGETALL(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, fields, values, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeHashAll(wf, fields, values)
+}
+
+func cmdCdtMapHEXISTS(wf io.Writer, ctx *context, args [][]byte) error {
+	x, err := cdtMapGetField(ctx, args[0], string(args[1]))
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, x != nil)
+}
+
+func cmdCdtMapHSTRLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	x, err := cdtMapGetField(ctx, args[0], string(args[1]))
+	if err != nil {
+		return err
+	}
+	return writeStrLen(wf, x)
+}
+
+func cmdCdtMapHLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	rec, err := cdtMapRead(ctx, key, as.MapSizeOp(cdtMapBinName), as.GetOpForBin(FIELD_EXPIRATIONS_BIN_NAME))
+	if err != nil {
+		return err
+	}
+	size := 0
+	if rec != nil {
+		size, _ = rec.Bins[cdtMapBinName].(int)
+		expirations := fieldExpirations(rec)
+		now := nowMillis()
+		for field := range expirations {
+			if fieldExpired(expirations, field, now) {
+				size--
+			}
+		}
+	}
+	return writeLine(wf, ":"+strconv.Itoa(size))
+}
+
+func cmdCdtMapHKEYS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, fields, _, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeHashKeys(wf, fields)
+}
+
+func cmdCdtMapHVALS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, fields, values, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeHashValues(wf, fields, values)
+}
+
+func cmdCdtMapHRANDFIELD(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, fields, values, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeRandomFields(wf, fields, values, args[1:])
+}
+
+func cdtMapHIncrByEx(wf io.Writer, ctx *context, k []byte, field []byte, incr []byte, ttl int) error {
+	v, ok := parseInt(incr)
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	err = purgeFields(ctx, key, true, false, string(field))
+	if err != nil {
+		return err
+	}
+	results, reply, err := cdtMapIncrBy(ctx, key, []string{string(field)}, []int64{v}, ttl)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeIncrResult(wf, results[0], "")
+}
+
+func cmdCdtMapHINCRBY(wf io.Writer, ctx *context, args [][]byte) error {
+	return cdtMapHIncrByEx(wf, ctx, args[0], args[1], args[2], -1)
+}
+
+func cmdCdtMapHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
+	ttl, err := strconv.Atoi(string(args[3]))
+	if err != nil {
+		return err
+	}
+	return cdtMapHIncrByEx(wf, ctx, args[0], args[1], args[2], ttl)
+}
+
+func cmdCdtMapHMINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	ttl, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	a := args[2:]
+	fields := make([]string, 0, len(a)/2)
+	incrs := make([]int64, 0, len(a)/2)
+	index := make(map[string]int)
+	for i := 0; i+1 < len(a); i += 2 {
+		incr, ok := parseInt(a[i+1])
+		if !ok {
+			return writeErrorReply(wf, errNotInteger)
+		}
+		field := string(a[i])
+		if j, ok := index[field]; ok {
+			// a field given twice is incremented once by the sum
+			incrs[j] += incr
+			continue
+		}
+		index[field] = len(fields)
+		fields = append(fields, field)
+		incrs = append(incrs, incr)
+	}
+	if len(fields) == 0 {
+		err := ctx.client.Touch(fillWritePolicyEx(ctx, ttl, false), key)
+		if err != nil && errResultCode(err) != ase.KEY_NOT_FOUND_ERROR {
+			return err
+		}
+		return writeLine(wf, "+OK")
+	}
+	err = purgeFields(ctx, key, true, false, fields...)
+	if err != nil {
+		return err
+	}
+	_, reply, err := cdtMapIncrBy(ctx, key, fields, incrs, ttl)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeLine(wf, "+OK")
+}
+
+func cmdCdtMapHINCRBYFLOAT(wf io.Writer, ctx *context, args [][]byte) error {
+	incr, ok := parseFloat(args[2])
+	if !ok {
+		return writeErrorReply(wf, "ERR value is not a valid float")
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = purgeFields(ctx, key, true, false, string(args[1]))
+	if err != nil {
+		return err
+	}
+	result, reply, err := cdtMapIncrByFloat(ctx, key, string(args[1]), incr)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeByteArray(wf, []byte(formatFloat(result)))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Read coalescing: with "coalesce_reads" in the configuration of a set,
+// identical read commands (same command, key and arguments) received while
+// the first one is running wait for its reply instead of reading Aerospike.
+// A write through this instance detaches the running reads of its keys
+// before and after being applied, and its reply is sent after that, so the
+// reads received after it do not get a reply read before it.
+
+type coalescedCall struct {
+	wg    sync.WaitGroup
+	reply []byte
+	err   error
+}
+
+type coalescer struct {
+	mu sync.Mutex
+	// running calls by key, then by command and arguments
+	calls map[string]map[string]*coalescedCall
+	// requests which have used the reply of another one
+	deduplicated uint32
+}
+
+// Read commands which are not coalesced: random or changing replies, or
+// several keys
+var coalesceExcludedCommands = []string{"HRANDFIELD", "MGET", "HOTKEYS", "SCAN", "KEYS"}
+
+// do runs f, or waits for the running call on the key k with the same
+// command and arguments
+func (c *coalescer) do(k string, cmd string, f func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	if call, ok := c.calls[k][cmd]; ok {
+		c.mu.Unlock()
+		atomic.AddUint32(&c.deduplicated, 1)
+		call.wg.Wait()
+		return call.reply, call.err
+	}
+	call := &coalescedCall{}
+	call.wg.Add(1)
+	if c.calls[k] == nil {
+		c.calls[k] = make(map[string]*coalescedCall)
+	}
+	c.calls[k][cmd] = call
+	c.mu.Unlock()
+
+	call.reply, call.err = f()
+
+	c.mu.Lock()
+	// the call may have been detached, and replaced by a newer one
+	if c.calls[k][cmd] == call {
+		delete(c.calls[k], cmd)
+		if len(c.calls[k]) == 0 {
+			delete(c.calls, k)
+		}
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+	return call.reply, call.err
+}
+
+// detach makes the next reads of the key k start a new call
+func (c *coalescer) detach(k []byte) {
+	c.mu.Lock()
+	delete(c.calls, string(k))
+	c.mu.Unlock()
+}
+
+func (c *coalescer) read(name string, h handler) handler {
+	return handler{h.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		cmd := nearCacheEntryKey(name, nil, args)
+		reply, err := c.do(string(args[0]), string(cmd), func() ([]byte, error) {
+			buf := bytes.NewBuffer(nil)
+			err := h.f(buf, ctx, args)
+			return buf.Bytes(), err
+		})
+		if err != nil {
+			return err
+		}
+		return write(wf, reply)
+	}}
+}
+
+// write detaches the reads of the written keys before the write, and again
+// before sending its reply: a read started during the write is not joined
+// by the reads sent once the write is acknowledged
+func (c *coalescer) write(name string, h handler) handler {
+	return handler{h.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		keys := nearCacheWrittenKeys(name, args)
+		c.detachAll(name, keys)
+		buf := bytes.NewBuffer(nil)
+		err := h.f(buf, ctx, args)
+		c.detachAll(name, keys)
+		if buf.Len() > 0 {
+			if werr := write(wf, buf.Bytes()); err == nil {
+				err = werr
+			}
+		}
+		return err
+	}}
+}
+
+func (c *coalescer) detachAll(name string, keys [][]byte) {
+	if name == "FLUSHDB" {
+		c.mu.Lock()
+		c.calls = make(map[string]map[string]*coalescedCall)
+		c.mu.Unlock()
+	}
+	for _, k := range keys {
+		c.detach(k)
+	}
+}
+
+// sendStats sends the number of deduplicated requests since the last call
+func (c *coalescer) sendStats(conn *net.UDPConn, prefix string) {
+	deduplicated := atomic.SwapUint32(&c.deduplicated, 0)
+	udpSend(conn, prefix+"coalesced:"+strconv.Itoa(int(deduplicated))+"|c")
+}
+
+func coalesceHandlers(handlers map[string]handler, config map[string]interface{}, ctx *context) map[string]handler {
+	if config["coalesce_reads"] == nil {
+		return handlers
+	}
+	c := &coalescer{calls: make(map[string]map[string]*coalescedCall)}
+	ctx.coalescer = c
+	log.Printf("%s: Coalescing identical reads", ctx.set)
+
+	excluded := make(map[string]bool)
+	for _, name := range coalesceExcludedCommands {
+		excluded[name] = true
+	}
+	readOnly := make(map[string]bool)
+	for _, name := range nearCacheReadOnlyCommands {
+		readOnly[name] = true
+	}
+	wrapped := make(map[string]handler, len(handlers))
+	for name, h := range handlers {
+		if excluded[name] {
+			wrapped[name] = h
+		} else if readOnly[name] {
+			wrapped[name] = c.read(name, h)
+		} else {
+			wrapped[name] = c.write(name, h)
+		}
+	}
+	return wrapped
+}
@@ -1,9 +1,9 @@
 package main
 
 import (
-	"encoding/base64"
 	"io"
 	"log"
+	"math"
 	"strconv"
 	"strings"
 
@@ -59,7 +59,19 @@ func cmdMGET(wf io.Writer, ctx *context, args [][]byte) error {
 }
 
 func cmdHGET(wf io.Writer, ctx *context, args [][]byte) error {
-	return get(wf, ctx, args[0], string(args[1]))
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	values, err := hashGetFields(ctx, key, string(args[1]))
+	if err != nil {
+		return err
+	}
+	x := values[string(args[1])]
+	if x == nil {
+		return writeLine(wf, "$-1")
+	}
+	return writeValue(wf, x)
 }
 
 func setex(wf io.Writer, ctx *context, k []byte, binName string, content []byte, ttl int, createOnly bool) error {
@@ -84,7 +96,145 @@ func setex(wf io.Writer, ctx *context, k []byte, binName string, content []byte,
 }
 
 func cmdSET(wf io.Writer, ctx *context, args [][]byte) error {
-	return setex(wf, ctx, args[0], binName, args[1], -1, false)
+	ttl := -1
+	action := as.UPDATE
+	keepTTL := false
+	withGet := false
+	hasExpire := false
+	expired := false
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "NX":
+			if action == as.UPDATE_ONLY {
+				return writeErrorReply(wf, "ERR syntax error")
+			}
+			action = as.CREATE_ONLY
+		case "XX":
+			if action == as.CREATE_ONLY {
+				return writeErrorReply(wf, "ERR syntax error")
+			}
+			action = as.UPDATE_ONLY
+		case "KEEPTTL":
+			if hasExpire {
+				return writeErrorReply(wf, "ERR syntax error")
+			}
+			keepTTL = true
+		case "GET":
+			withGet = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if hasExpire || keepTTL || i+1 >= len(args) {
+				return writeErrorReply(wf, "ERR syntax error")
+			}
+			i++
+			v, ok := parseExpireOption(option, args[i])
+			if !ok {
+				return writeErrorReply(wf, "ERR invalid expire time in 'set' command")
+			}
+			hasExpire = true
+			if v <= 0 {
+				expired = true
+			} else {
+				ttl = v
+			}
+		default:
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+	}
+	if keepTTL {
+		ttl = ttlDontUpdate
+	}
+	if action == as.UPDATE && !withGet && !keepTTL && !expired {
+		return setex(wf, ctx, args[0], binName, args[1], ttl, false)
+	}
+
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if expired {
+		return setExpired(wf, ctx, key, action, withGet)
+	}
+	if action == as.CREATE_ONLY && withGet {
+		return setNXGet(wf, ctx, key, args[1], ttl)
+	}
+	ops := make([]*as.Operation, 0, 2)
+	if withGet {
+		ops = append(ops, as.GetOpForBin(binName))
+	}
+	ops = append(ops, as.PutOp(as.NewBin(binName, encode(ctx, args[1]))))
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttl, action), key, ops...)
+	if err != nil {
+		code := errResultCode(err)
+		// with XX, the key did not exist: GET returns nil
+		if action == as.CREATE_ONLY && code == ase.KEY_EXISTS_ERROR || action == as.UPDATE_ONLY && code == ase.KEY_NOT_FOUND_ERROR {
+			return writeLine(wf, "$-1")
+		}
+		return err
+	}
+	if withGet {
+		return writeBin(wf, rec, binName, "$-1")
+	}
+	return writeLine(wf, "+OK")
+}
+
+// setNXGet creates the key, or returns the value which prevented it. If the
+// key is deleted between the failed create and the read, the create is
+// tried again, so the reply is the value of a key which existed.
+func setNXGet(wf io.Writer, ctx *context, key *as.Key, value []byte, ttl int) error {
+	var rec *as.Record
+	err := casRetry(func() error {
+		_, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttl, as.CREATE_ONLY), key, as.PutOp(as.NewBin(binName, encode(ctx, value))))
+		if errResultCode(err) != ase.KEY_EXISTS_ERROR {
+			return err
+		}
+		rec, err = ctx.client.Get(ctx.readPolicy, key, binName)
+		if err == nil && rec == nil {
+			return ase.NewAerospikeError(ase.GENERATION_ERROR)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeBin(wf, rec, binName, "$-1")
+}
+
+// setExpired applies a SET whose absolute expiration time is in the past:
+// the key is deleted, unless NX or XX prevent the SET. With GET, the value
+// is read and deleted at the same generation.
+func setExpired(wf io.Writer, ctx *context, key *as.Key, action as.RecordExistsAction, withGet bool) error {
+	if !withGet && action != as.CREATE_ONLY {
+		existed, err := ctx.client.Delete(ctx.writePolicy, key)
+		if err != nil {
+			return err
+		}
+		if !existed && action == as.UPDATE_ONLY {
+			return writeLine(wf, "$-1")
+		}
+		return writeLine(wf, "+OK")
+	}
+	var rec *as.Record
+	err := casRetry(func() error {
+		var err error
+		rec, err = ctx.client.Get(ctx.readPolicy, key, binName)
+		if err != nil || rec == nil || action == as.CREATE_ONLY {
+			return err
+		}
+		_, err = ctx.client.Delete(fillWritePolicyCas(ctx, -1, rec), key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if withGet {
+		return writeBin(wf, rec, binName, "$-1")
+	}
+	if rec != nil {
+		// NX on an existing key
+		return writeLine(wf, "$-1")
+	}
+	return writeLine(wf, "+OK")
 }
 
 func cmdSETEX(wf io.Writer, ctx *context, args [][]byte) error {
@@ -126,15 +276,22 @@ func cmdSETNXEX(wf io.Writer, ctx *context, args [][]byte) error {
 }
 
 func cmdHSET(wf io.Writer, ctx *context, args [][]byte) error {
+	if len(args)%2 != 1 {
+		return writeErrorReply(wf, "ERR wrong number of arguments for 'hset' command")
+	}
 	key, err := buildKey(ctx, args[0])
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, "HSET", as.NewValue(string(args[1])), as.NewValue(encode(ctx, args[2])))
+	err = purgeFields(ctx, key, false, true, pairFields(args[1:])...)
 	if err != nil {
 		return err
 	}
-	return writeLine(wf, ":"+strconv.Itoa(rec.(int)))
+	created, err := hashSet(ctx, key, args[1:])
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(created))
 }
 
 func cmdHDEL(wf io.Writer, ctx *context, args [][]byte) error {
@@ -142,168 +299,329 @@ func cmdHDEL(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, "HDEL", as.NewValue(string(args[1])))
-	if err != nil {
-		return err
+	fields := make([]string, len(args)-1)
+	for i, f := range args[1:] {
+		fields[i] = string(f)
 	}
-	return writeLine(wf, ":"+strconv.Itoa(rec.(int)))
-}
-
-func arrayPush(wf io.Writer, ctx *context, args [][]byte, f string, ttl int) error {
-	key, err := buildKey(ctx, args[0])
+	err = purgeFields(ctx, key, false, true, fields...)
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, f, as.NewValue(binName), as.NewValue(encode(ctx, args[1])), as.NewValue(ttl))
+	removed, err := hashDel(ctx, key, fields)
 	if err != nil {
 		return err
 	}
-	return writeLine(wf, ":"+strconv.Itoa(rec.(int)))
+	return writeLine(wf, ":"+strconv.Itoa(removed))
 }
 
-func cmdRPUSH(wf io.Writer, ctx *context, args [][]byte) error {
-	return arrayPush(wf, ctx, args, "RPUSH", -1)
+const errNotInteger = "ERR value is not an integer or out of range"
+const errOverflow = "ERR increment or decrement would overflow"
+
+func parseInt(buf []byte) (int64, bool) {
+	v, err := strconv.ParseInt(string(buf), 10, 64)
+	return v, err == nil
 }
 
-func cmdRPUSHEX(wf io.Writer, ctx *context, args [][]byte) error {
-	ttl, err := strconv.Atoi(string(args[2]))
+// parseIntValue converts a stored value to an integer, nil being 0.
+// Floats are not integers.
+func parseIntValue(x interface{}) (int64, bool) {
+	switch x.(type) {
+	case nil:
+		return 0, true
+	case int:
+		return int64(x.(int)), true
+	case float64:
+		return 0, false
+	}
+	buf, err := decodeValue(x)
 	if err != nil {
-		return err
+		return 0, false
 	}
+	return parseInt(buf)
+}
 
-	return arrayPush(wf, ctx, args, "RPUSH", ttl)
+// addOverflows returns true if result, computed as old + incr, has wrapped
+// around
+func addOverflows(result int64, incr int64) bool {
+	old := result - incr
+	return incr > 0 && result < old || incr < 0 && result > old
 }
 
-func cmdLPUSH(wf io.Writer, ctx *context, args [][]byte) error {
-	return arrayPush(wf, ctx, args, "LPUSH", -1)
+// fixedTTL returns a prepare function for incrementBin which only gives the
+// TTL of the write
+func fixedTTL(ttl int) func(rec *as.Record) (int, error) {
+	return func(rec *as.Record) (int, error) {
+		return ttl, nil
+	}
 }
 
-func cmdLPUSHEX(wf io.Writer, ctx *context, args [][]byte) error {
-	ttl, err := strconv.Atoi(string(args[2]))
-	if err != nil {
-		return err
+// intIncrement returns the function adding incr to an integer value, a
+// string holding an integer being converted
+func intIncrement(incr int64) func(current interface{}) (interface{}, string) {
+	return func(current interface{}) (interface{}, string) {
+		v, ok := parseIntValue(current)
+		if !ok {
+			return nil, errNotInteger
+		}
+		if addOverflows(v+incr, incr) {
+			return nil, errOverflow
+		}
+		return v + incr, ""
 	}
+}
 
-	return arrayPush(wf, ctx, args, "LPUSH", ttl)
+// floatIncrement returns the function adding incr to a float value, an
+// integer or a string being converted
+func floatIncrement(incr float64) func(current interface{}) (interface{}, string) {
+	return func(current interface{}) (interface{}, string) {
+		f, ok := parseFloatValue(current)
+		if !ok {
+			return nil, "ERR value is not a valid float"
+		}
+		result := f + incr
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, "ERR increment would produce NaN or Infinity"
+		}
+		return result, ""
+	}
 }
 
-func arrayPop(wf io.Writer, ctx *context, args [][]byte, f string) error {
-	key, err := buildKey(ctx, args[0])
-	if err != nil {
-		return err
+// addToBins adds incrs to the integer bins in a single operation, with the
+// extra operations, and returns the new values. It returns false without
+// changing the record if a bin is not an integer, or if the record does not
+// exist with an UPDATE_ONLY policy. An increment which overflows is reverted,
+// as Aerospike wraps around, and false is returned too: the caller then uses
+// incrementBin, which reports the errors.
+func addToBins(ctx *context, policy *as.WritePolicy, key *as.Key, bins []string, incrs []int64, extra ...*as.Operation) ([]int64, bool, error) {
+	ops := append(make([]*as.Operation, 0, len(extra)+2*len(bins)), extra...)
+	for i, bin := range bins {
+		ops = append(ops, as.AddOp(as.NewBin(bin, incrs[i])))
+	}
+	for _, bin := range bins {
+		ops = append(ops, as.GetOpForBin(bin))
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, f, as.NewValue(binName), as.NewValue(1), as.NewValue(-1))
+	rec, err := ctx.client.Operate(policy, key, ops...)
 	if err != nil {
+		code := errResultCode(err)
+		if code == ase.BIN_TYPE_ERROR || code == ase.PARAMETER_ERROR || code == ase.KEY_NOT_FOUND_ERROR && policy.RecordExistsAction == as.UPDATE_ONLY {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	results := make([]int64, len(bins))
+	overflow := false
+	for i, bin := range bins {
+		v, _ := rec.Bins[bin].(int)
+		results[i] = int64(v)
+		overflow = overflow || addOverflows(results[i], incrs[i])
+	}
+	if !overflow {
+		return results, true, nil
+	}
+	// wrapping additions are reverted exactly, even after concurrent ones
+	ops = make([]*as.Operation, len(bins))
+	for i, bin := range bins {
+		ops[i] = as.AddOp(as.NewBin(bin, -incrs[i]))
+	}
+	revert := fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY)
+	_, err = ctx.client.Operate(revert, key, ops...)
+	return nil, false, err
+}
+
+// incrementBin reads a bin, and writes the value computed by next with the
+// extra operations if the record has not been modified in the meantime, so
+// an increment which would overflow is refused before being applied. It is
+// used when the bin has to be converted, or the increment checked. prepare is called before the write with the record read,
+// nil if it does not exist, and returns the TTL of the write. Returns the new
+// value or the error reply of next, and true if the record has been created.
+func incrementBin(ctx *context, key *as.Key, bin string, prepare func(rec *as.Record) (int, error), next func(current interface{}) (interface{}, string), extra ...*as.Operation) (interface{}, string, bool, error) {
+	var result interface{}
+	reply := ""
+	created := false
+	err := casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key, bin)
+		if err != nil {
+			return err
+		}
+		var current interface{}
+		if rec != nil {
+			current = rec.Bins[bin]
+		}
+		result, reply = next(current)
+		if reply != "" {
+			return nil
+		}
+		ttl, err := prepare(rec)
+		if err != nil {
+			return err
+		}
+		policy := fillWritePolicyCas(ctx, ttl, rec)
+		if rec != nil {
+			// the record must not be created again if it has been deleted
+			policy.RecordExistsAction = as.UPDATE_ONLY
+		}
+		ops := append(append(make([]*as.Operation, 0, len(extra)+1), extra...), as.PutOp(as.NewBin(bin, result)))
+		_, err = ctx.client.Operate(policy, key, ops...)
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return ase.NewAerospikeError(ase.GENERATION_ERROR)
+		}
+		created = rec == nil
 		return err
+	})
+	return result, reply, created, err
+}
+
+// incrBy adds incr to an integer bin. A string bin holding an integer is
+// converted to an integer bin. The extra operations are applied with the
+// increment. Returns the new value, or an error reply.
+func incrBy(ctx *context, key *as.Key, bin string, incr int64, ttl int, extra ...*as.Operation) (int64, string, error) {
+	results, ok, err := addToBins(ctx, fillWritePolicyEx(ctx, ttl, false), key, []string{bin}, []int64{incr}, extra...)
+	if err != nil {
+		return 0, "", err
 	}
-	if rec == nil {
-		return writeLine(wf, "$-1")
+	if ok {
+		return results[0], "", nil
 	}
-	a := rec.([]interface{})
-	if len(a) == 0 {
-		return writeLine(wf, "$-1")
+	result, reply, _, err := incrementBin(ctx, key, bin, fixedTTL(ttl), intIncrement(incr), extra...)
+	if err != nil || reply != "" {
+		return 0, reply, err
 	}
-	x := rec.([]interface{})[0]
-	// backward compat
-	switch x.(type) {
-	case int:
-		return writeByteArray(wf, []byte(strconv.Itoa(x.(int))))
-	case string:
-		s := x.(string)
-		if strings.HasPrefix(s, "__64__") {
-			bytes, err := base64.StdEncoding.DecodeString(s[6:])
-			if err != nil {
-				return err
-			}
-			return writeByteArray(wf, bytes)
-		}
-		return writeByteArray(wf, []byte(s))
-	// end of backward compat
-	default:
-		return writeByteArray(wf, x.([]byte))
-	}
-}
-
-func cmdRPOP(wf io.Writer, ctx *context, args [][]byte) error {
-	return arrayPop(wf, ctx, args, "RPOP")
+	return result.(int64), "", nil
 }
 
-func cmdLPOP(wf io.Writer, ctx *context, args [][]byte) error {
-	return arrayPop(wf, ctx, args, "LPOP")
+func writeIncrResult(wf io.Writer, result int64, reply string) error {
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeLine(wf, ":"+strconv.FormatInt(result, 10))
 }
 
-func cmdLLEN(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := buildKey(ctx, args[0])
+func hIncrByEx(wf io.Writer, ctx *context, k []byte, field string, incr int64, ttl int) error {
+	key, err := buildKey(ctx, k)
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.Get(ctx.readPolicy, key, binName+"_size")
+	result, reply, err := incrBy(ctx, key, field, incr, ttl)
 	if err != nil {
 		return err
 	}
-	return writeBinInt(wf, rec, binName+"_size")
+	return writeIncrResult(wf, result, reply)
 }
 
-func cmdLRANGE(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := buildKey(ctx, args[0])
-	if err != nil {
-		return err
+// parseFloatValue converts a stored value to a float, nil being 0
+func parseFloatValue(x interface{}) (float64, bool) {
+	switch x.(type) {
+	case nil:
+		return 0, true
+	case int:
+		return float64(x.(int)), true
+	case float64:
+		return x.(float64), true
 	}
-	start, err := strconv.Atoi(string(args[1]))
+	buf, err := decodeValue(x)
 	if err != nil {
-		return err
+		return 0, false
 	}
-	stop, err := strconv.Atoi(string(args[2]))
-	if err != nil {
-		return err
+	return parseFloat(buf)
+}
+
+func parseFloat(buf []byte) (float64, bool) {
+	f, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, "LRANGE", as.NewValue(binName), as.NewValue(start), as.NewValue(stop))
+	return f, true
+}
+
+// incrByFloat adds incr to a bin, stored as an Aerospike float. An integer or
+// a string bin is converted to a float. The extra operations are applied
+// with the increment. Returns the new value, or an error reply.
+func incrByFloat(ctx *context, key *as.Key, bin string, incr float64, ttl int, extra ...*as.Operation) (float64, string, error) {
+	result, ok, err := addFloatToBin(ctx, fillWritePolicyEx(ctx, ttl, false), key, bin, incr, extra...)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
-	if rec == nil {
-		return writeLine(wf, "$-1")
+	if ok {
+		return result, "", nil
 	}
-	return writeArray(wf, rec.([]interface{}))
+	return incrByFloatChecked(ctx, key, bin, incr, ttl, extra...)
 }
 
-func cmdLTRIM(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := buildKey(ctx, args[0])
+// addFloatToBin adds incr to a float bin in a single operation, with the
+// extra operations, and returns the new value. It returns false without
+// changing the record if the bin is not a float, or if the record does not
+// exist with an UPDATE_ONLY policy. A result which is not finite is replaced
+// by the previous value, read by the same operation, and false is returned.
+func addFloatToBin(ctx *context, policy *as.WritePolicy, key *as.Key, bin string, incr float64, extra ...*as.Operation) (float64, bool, error) {
+	ops := append(append(make([]*as.Operation, 0, len(extra)+3), extra...), as.GetOpForBin(bin), as.AddOp(as.NewBin(bin, incr)), as.GetOpForBin(bin))
+	rec, err := ctx.client.Operate(policy, key, ops...)
 	if err != nil {
-		return err
+		code := errResultCode(err)
+		if code == ase.BIN_TYPE_ERROR || code == ase.PARAMETER_ERROR || code == ase.KEY_NOT_FOUND_ERROR && policy.RecordExistsAction == as.UPDATE_ONLY {
+			return 0, false, nil
+		}
+		return 0, false, err
 	}
-	start, err := strconv.Atoi(string(args[1]))
-	if err != nil {
-		return err
+	// both reads of the bin, the first one is missing for a new bin
+	var previous, result interface{}
+	if values, ok := rec.Bins[bin].([]interface{}); ok && len(values) == 2 {
+		previous, result = values[0], values[1]
+	} else {
+		result = rec.Bins[bin]
 	}
-	stop, err := strconv.Atoi(string(args[2]))
-	if err != nil {
-		return err
+	f, _ := result.(float64)
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f, true, nil
 	}
-	rec, err := ctx.client.Execute(ctx.writePolicy, key, MODULE_NAME, "LTRIM", as.NewValue(binName), as.NewValue(start), as.NewValue(stop))
-	if err != nil {
-		return err
+	revert := fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY)
+	revert.GenerationPolicy = as.EXPECT_GEN_EQUAL
+	revert.Generation = rec.Generation
+	_, err = ctx.client.Operate(revert, key, as.PutOp(as.NewBin(bin, previous)))
+	if errResultCode(err) == ase.GENERATION_ERROR {
+		log.Printf("%s: unable to revert an infinite increment of %s", ctx.set, bin)
+		err = nil
 	}
-	if rec == nil {
-		return writeLine(wf, "$-1")
+	return 0, false, err
+}
+
+// incrByFloatChecked is the read / check / write cycle of incrByFloat
+func incrByFloatChecked(ctx *context, key *as.Key, bin string, incr float64, ttl int, extra ...*as.Operation) (float64, string, error) {
+	result, reply, _, err := incrementBin(ctx, key, bin, fixedTTL(ttl), floatIncrement(incr), extra...)
+	if err != nil || reply != "" {
+		return 0, reply, err
 	}
-	return writeLine(wf, "+OK")
+	return result.(float64), "", nil
 }
 
-func hIncrByEx(wf io.Writer, ctx *context, k []byte, field string, incr int, ttl int) error {
+func hIncrByFloat(wf io.Writer, ctx *context, k []byte, field string, incr []byte) error {
 	key, err := buildKey(ctx, k)
 	if err != nil {
 		return err
 	}
-	bin := as.NewBin(field, incr)
-	rec, err := ctx.client.Operate(fillWritePolicyEx(ctx, ttl, false), key, as.AddOp(bin), as.GetOpForBin(field))
+	f, ok := parseFloat(incr)
+	if !ok {
+		return writeErrorReply(wf, "ERR value is not a valid float")
+	}
+	result, reply, err := incrByFloat(ctx, key, field, f, -1)
 	if err != nil {
-		if errResultCode(err) == ase.BIN_TYPE_ERROR {
-			return writeLine(wf, "$-1")
-		}
 		return err
 	}
-	return writeBinInt(wf, rec, field)
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeByteArray(wf, []byte(formatFloat(result)))
+}
+
+func cmdINCRBYFLOAT(wf io.Writer, ctx *context, args [][]byte) error {
+	return hIncrByFloat(wf, ctx, args[0], binName, args[1])
+}
+
+func cmdHINCRBYFLOAT(wf io.Writer, ctx *context, args [][]byte) error {
+	err := purgeHashFields(ctx, args[0], false, false, string(args[1]))
+	if err != nil {
+		return err
+	}
+	return hIncrByFloat(wf, ctx, args[0], string(args[1]), args[2])
 }
 
 func cmdINCR(wf io.Writer, ctx *context, args [][]byte) error {
@@ -315,15 +633,19 @@ func cmdDECR(wf io.Writer, ctx *context, args [][]byte) error {
 }
 
 func cmdINCRBY(wf io.Writer, ctx *context, args [][]byte) error {
-	incr, err := strconv.Atoi(string(args[1]))
-	if err != nil {
-		return err
+	incr, ok := parseInt(args[1])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
 	}
 	return hIncrByEx(wf, ctx, args[0], binName, incr, -1)
 }
 
 func cmdHINCRBY(wf io.Writer, ctx *context, args [][]byte) error {
-	incr, err := strconv.Atoi(string(args[2]))
+	incr, ok := parseInt(args[2])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
+	err := purgeHashFields(ctx, args[0], false, false, string(args[1]))
 	if err != nil {
 		return err
 	}
@@ -331,11 +653,15 @@ func cmdHINCRBY(wf io.Writer, ctx *context, args [][]byte) error {
 }
 
 func cmdHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
-	incr, err := strconv.Atoi(string(args[2]))
+	incr, ok := parseInt(args[2])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
+	ttl, err := strconv.Atoi(string(args[3]))
 	if err != nil {
 		return err
 	}
-	ttl, err := strconv.Atoi(string(args[3]))
+	err = purgeHashFields(ctx, args[0], false, false, string(args[1]))
 	if err != nil {
 		return err
 	}
@@ -343,9 +669,12 @@ func cmdHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
 }
 
 func cmdDECRBY(wf io.Writer, ctx *context, args [][]byte) error {
-	decr, err := strconv.Atoi(string(args[1]))
-	if err != nil {
-		return err
+	decr, ok := parseInt(args[1])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
+	if decr == math.MinInt64 {
+		return writeErrorReply(wf, "ERR decrement would overflow")
 	}
 	return hIncrByEx(wf, ctx, args[0], binName, -decr, -1)
 }
@@ -359,7 +688,7 @@ func cmdHMGET(wf io.Writer, ctx *context, args [][]byte) error {
 	for i, e := range args[1:] {
 		a[i] = string(e)
 	}
-	rec, err := ctx.client.Get(ctx.readPolicy, key, a...)
+	values, err := hashGetFields(ctx, key, a...)
 	if err != nil {
 		return err
 	}
@@ -368,7 +697,11 @@ func cmdHMGET(wf io.Writer, ctx *context, args [][]byte) error {
 		return err
 	}
 	for _, e := range a {
-		err = writeBin(wf, rec, e, "$-1")
+		if values[e] == nil {
+			err = writeLine(wf, "$-1")
+		} else {
+			err = writeValue(wf, values[e])
+		}
 		if err != nil {
 			return err
 		}
@@ -381,6 +714,10 @@ func cmdHMSET(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
+	err = purgeFields(ctx, key, false, true, pairFields(args[1:])...)
+	if err != nil {
+		return err
+	}
 	m := make(map[string]interface{})
 	for i := 1; i+1 < len(args); i += 2 {
 		m[string(args[i])] = encode(ctx, args[i+1])
@@ -401,7 +738,7 @@ func cmdHGETALL(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
-	a := rec.([]interface{})
+	a := hGetAllLive(rec.([]interface{}))
 	err = writeLine(wf, "*"+strconv.Itoa(len(a)))
 	if err != nil {
 		return err
@@ -419,43 +756,6 @@ func cmdHGETALL(wf io.Writer, ctx *context, args [][]byte) error {
 	return nil
 }
 
-func cmdEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := buildKey(ctx, args[0])
-	if err != nil {
-		return err
-	}
-
-	ttl, err := strconv.Atoi(string(args[1]))
-	if err != nil {
-		return err
-	}
-
-	err = ctx.client.Touch(fillWritePolicyEx(ctx, ttl, false), key)
-	if err != nil {
-		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
-			return writeLine(wf, ":0")
-		}
-		return err
-	}
-	return writeLine(wf, ":1")
-}
-
-func cmdTTL(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := buildKey(ctx, args[0])
-	if err != nil {
-		return err
-	}
-
-	rec, err := ctx.client.GetHeader(ctx.readPolicy, key)
-	if err != nil {
-		return err
-	}
-	if rec == nil {
-		return writeLine(wf, ":-2")
-	}
-	return writeLine(wf, ":"+strconv.FormatUint(uint64(rec.Expiration), 10))
-}
-
 func cmdFLUSHDB(wf io.Writer, ctx *context, args [][]byte) error {
 	stmt := as.NewStatement(ctx.ns, ctx.set)
 	delTask, err := ctx.client.ExecuteUDF(nil, stmt, MODULE_NAME, "DELETE")
@@ -489,18 +789,64 @@ func cmdHMINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
 		}
 		return writeLine(wf, "+OK")
 	}
-	ops := make([]*as.Operation, 0)
 	a := args[2:]
+	fields := make([]string, 0, len(a)/2)
+	incrs := make(map[string]int64)
 	for i := 0; i+1 < len(a); i += 2 {
-		incr, err := strconv.Atoi(string(a[i+1]))
+		incr, ok := parseInt(a[i+1])
+		if !ok {
+			return writeErrorReply(wf, errNotInteger)
+		}
+		field := string(a[i])
+		if _, ok := incrs[field]; !ok {
+			fields = append(fields, field)
+		}
+		// a field given twice is incremented once by the sum
+		incrs[field] += incr
+	}
+	err = purgeFields(ctx, key, false, false, fields...)
+	if err != nil {
+		return err
+	}
+	values := make([]int64, len(fields))
+	for i, field := range fields {
+		values[i] = incrs[field]
+	}
+	_, ok, err := addToBins(ctx, fillWritePolicyEx(ctx, ttl, false), key, fields, values)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return writeLine(wf, "+OK")
+	}
+	// all the fields are checked before any is written
+	reply := ""
+	err = casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key, fields...)
 		if err != nil {
 			return err
 		}
-		ops = append(ops, as.AddOp(as.NewBin(string(a[i]), incr)))
-	}
-	_, err = ctx.client.Operate(fillWritePolicyEx(ctx, ttl, false), key, ops...)
+		ops := make([]*as.Operation, 0, len(fields))
+		for _, field := range fields {
+			var current interface{}
+			if rec != nil {
+				current = rec.Bins[field]
+			}
+			var result interface{}
+			result, reply = intIncrement(incrs[field])(current)
+			if reply != "" {
+				return nil
+			}
+			ops = append(ops, as.PutOp(as.NewBin(field, result)))
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, ops...)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
 	return writeLine(wf, "+OK")
 }
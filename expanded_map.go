@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"io"
 	"math/rand"
 	"strconv"
@@ -35,12 +36,19 @@ func formatCompositeKey(ctx *context, key string, field string) (*as.Key, error)
 }
 
 func compositeExists(ctx *context, k string) (*string, error) {
-	if ctx.expandedMapCache != nil {
-		v, err := ctx.expandedMapCache.Get([]byte(k))
-		if err == nil {
-			s := string(v)
-			return &s, nil
+	return compositeLookup(ctx, k, false)
+}
+
+// compositeLookup returns the suffixed key of the map k, nil if the map does
+// not exist. If check is true, the main record is always read, and a map
+// cached as missing is read again.
+func compositeLookup(ctx *context, k string, check bool) (*string, error) {
+	s, ok := cacheGet(ctx, k)
+	if ok && !check {
+		if s == "" {
+			return nil, nil
 		}
+		return &s, nil
 	}
 	key, err := formatCompositeKey(ctx, k, MAIN_SUFFIX)
 	if err != nil {
@@ -51,12 +59,14 @@ func compositeExists(ctx *context, k string) (*string, error) {
 		return nil, err
 	}
 	if rec != nil && rec.Bins[ROOT_BIN_NAME] != nil {
-		s := rec.Bins[ROOT_BIN_NAME].(string)
-		if ctx.expandedMapCache != nil {
-			ctx.expandedMapCache.Set([]byte(k), []byte(s), ctx.expandedMapCacheTTL)
+		suffixedKey := rec.Bins[ROOT_BIN_NAME].(string)
+		// a recreated map has another suffixed key
+		if suffixedKey != s {
+			cacheSet(ctx, k, suffixedKey)
 		}
-		return &s, nil
+		return &suffixedKey, nil
 	}
+	cacheSetMissing(ctx, k)
 	return nil, nil
 }
 
@@ -65,7 +75,7 @@ func compositeExistsOrCreate(ctx *context, k string, ttl int) (*string, bool, er
 }
 
 func _compositeExistsOrCreate(ctx *context, k string, ttl int, canRetry bool) (*string, bool, error) {
-	suffixedKey, err := compositeExists(ctx, k)
+	suffixedKey, err := compositeLookup(ctx, k, true)
 	if err != nil {
 		return nil, false, err
 	}
@@ -89,8 +99,9 @@ func _compositeExistsOrCreate(ctx *context, k string, ttl int, canRetry bool) (*
 		return nil, false, err
 	}
 	rec := as.BinMap{
-		ROOT_BIN_NAME: kk,
-		"created_at":  now(),
+		ROOT_BIN_NAME:      kk,
+		DIRECTORY_BIN_NAME: 1,
+		"created_at":       now(),
 	}
 	err = ctx.client.Put(fillWritePolicyEx(ctx, ttl, true), key, rec)
 	if err != nil {
@@ -99,9 +110,9 @@ func _compositeExistsOrCreate(ctx *context, k string, ttl int, canRetry bool) (*
 		}
 		return nil, false, err
 	}
-	if ctx.expandedMapCache != nil {
-		ctx.expandedMapCache.Set([]byte(k), []byte(kk), ctx.expandedMapCacheTTL)
-	}
+	// replaces a negative entry
+	cacheSet(ctx, k, kk)
+	cacheNotifyPeers(ctx, "create", k)
 	return &kk, true, nil
 }
 
@@ -125,33 +136,102 @@ func cmdExpandedMapHGET(wf io.Writer, ctx *context, args [][]byte) error {
 	return writeBin(wf, rec, VALUE_BIN_NAME, "$-1")
 }
 
-func cmdExpandedMapHSET(wf io.Writer, ctx *context, args [][]byte) error {
-	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), -1)
+// parseFieldValues returns the fields of field / value pairs, in order, and
+// their values. The last value of a field given twice wins, like Redis.
+func parseFieldValues(args [][]byte) ([]string, map[string][]byte) {
+	fields := make([]string, 0, len(args)/2)
+	values := make(map[string][]byte)
+	for i := 0; i+1 < len(args); i += 2 {
+		field := string(args[i])
+		if _, ok := values[field]; !ok {
+			fields = append(fields, field)
+		}
+		values[field] = args[i+1]
+	}
+	return fields, values
+}
+
+// expandedMapPutFields writes the field records of the map k. Existing
+// records are only updated, without writing the directory. The others, and
+// the records deleted since they have been checked, are added to the
+// directory before and after being written. Returns the number of created
+// fields.
+func expandedMapPutFields(ctx *context, k string, suffixedKey string, fields []string, values map[string][]byte, ttl int) (int, error) {
+	keys := make([]*as.Key, len(fields))
+	for i, f := range fields {
+		key, err := formatCompositeKey(ctx, suffixedKey, f)
+		if err != nil {
+			return 0, err
+		}
+		keys[i] = key
+	}
+	exists, err := ctx.client.BatchExists(ctx.readPolicy, keys)
 	if err != nil {
+		return 0, err
+	}
+	put := func(i int, action as.RecordExistsAction) error {
+		rec := as.BinMap{
+			MAIN_KEY_BIN_NAME:   suffixedKey,
+			SECOND_KEY_BIN_NAME: fields[i],
+			VALUE_BIN_NAME:      encode(ctx, values[fields[i]]),
+			FIELD_TTL_BIN_NAME:  nil,
+			"created_at":        now(),
+		}
+		return ctx.client.Put(fillWritePolicyAction(ctx, ttl, action), keys[i], rec)
+	}
+	err = forEachBounded(len(fields), ctx.batchConcurrency, func(i int) error {
+		if !exists[i] {
+			return nil
+		}
+		err := put(i, as.UPDATE_ONLY)
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			// deleted in the meantime, created below
+			exists[i] = false
+			return nil
+		}
 		return err
+	})
+	if err != nil {
+		return 0, err
 	}
-	key, err := formatCompositeKey(ctx, *suffixedKey, string(args[1]))
+	created := make([]int, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for i, f := range fields {
+		if !exists[i] {
+			created = append(created, i)
+			names = append(names, f)
+		}
+	}
+	if len(created) == 0 {
+		return 0, nil
+	}
+	err = expandedMapAddFields(ctx, k, names...)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	exists, err := ctx.client.Exists(ctx.readPolicy, key)
+	err = forEachBounded(len(created), ctx.batchConcurrency, func(i int) error {
+		return put(created[i], as.UPDATE)
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	rec := as.BinMap{
-		MAIN_KEY_BIN_NAME:   *suffixedKey,
-		SECOND_KEY_BIN_NAME: string(args[1]),
-		VALUE_BIN_NAME:      encode(ctx, args[2]),
-		"created_at":        now(),
+	return len(created), expandedMapAddFields(ctx, k, names...)
+}
+
+func cmdExpandedMapHSET(wf io.Writer, ctx *context, args [][]byte) error {
+	if len(args)%2 != 1 {
+		return writeErrorReply(wf, "ERR wrong number of arguments for 'hset' command")
 	}
-	err = ctx.client.Put(ctx.writePolicy, key, rec)
+	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), -1)
 	if err != nil {
 		return err
 	}
-	if exists {
-		return writeLine(wf, ":0")
+	fields, values := parseFieldValues(args[1:])
+	created, err := expandedMapPutFields(ctx, string(args[0]), *suffixedKey, fields, values, -1)
+	if err != nil {
+		return err
 	}
-	return writeLine(wf, ":1")
+	return writeLine(wf, ":"+strconv.Itoa(created))
 }
 
 func cmdExpandedMapHDEL(wf io.Writer, ctx *context, args [][]byte) error {
@@ -162,70 +242,121 @@ func cmdExpandedMapHDEL(wf io.Writer, ctx *context, args [][]byte) error {
 	if suffixedKey == nil {
 		return writeLine(wf, ":0")
 	}
-	key, err := formatCompositeKey(ctx, *suffixedKey, string(args[1]))
-	if err != nil {
-		return err
+	removed := 0
+	for _, f := range args[1:] {
+		key, err := formatCompositeKey(ctx, *suffixedKey, string(f))
+		if err != nil {
+			return err
+		}
+		existed, err := ctx.client.Delete(ctx.writePolicy, key)
+		if err != nil {
+			return err
+		}
+		if existed {
+			removed++
+		}
+	}
+	fields := make([]string, len(args)-1)
+	for i, f := range args[1:] {
+		fields[i] = string(f)
 	}
-	existed, err := ctx.client.Delete(ctx.writePolicy, key)
+	err = expandedMapRemoveFields(ctx, string(args[0]), fields...)
 	if err != nil {
 		return err
 	}
-	if existed {
-		return writeLine(wf, ":1")
-	}
-	return writeLine(wf, ":0")
+	return writeLine(wf, ":"+strconv.Itoa(removed))
 }
 
-func cmdExpandedMapEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
-	ttl, err := strconv.Atoi(string(args[1]))
+// expandedMapExpireKey returns the main record of the expanded map if it
+// exists, the standard record otherwise
+func expandedMapExpireKey(ctx *context, k []byte) (*as.Key, bool, error) {
+	key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	key, err := formatCompositeKey(ctx, string(args[0]), MAIN_SUFFIX)
+	rec, err := ctx.client.GetHeader(ctx.readPolicy, key)
 	if err != nil {
-		return err
-	}
-	err = ctx.client.Touch(fillWritePolicyEx(ctx, ttl, false), key)
-	if err == nil {
-		return writeLine(wf, ":1")
+		return nil, false, err
 	}
-	if errResultCode(err) != ase.KEY_NOT_FOUND_ERROR {
-		return err
+	if rec != nil {
+		return key, true, nil
 	}
-	return cmdEXPIRE(wf, ctx, args)
+	key, err = buildKey(ctx, k)
+	return key, false, err
 }
 
-func cmdExpandedMapTTL(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := formatCompositeKey(ctx, string(args[0]), MAIN_SUFFIX)
+func expandedMapExpire(wf io.Writer, ctx *context, args [][]byte, option string) error {
+	ttl, conditions, reply := parseExpireArgs(args, option)
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	key, main, err := expandedMapExpireKey(ctx, args[0])
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.GetHeader(ctx.readPolicy, key)
+	remove := func() (bool, error) {
+		if main {
+			return expandedMapDelete(ctx, args[0], false)
+		}
+		return ctx.client.Delete(ctx.writePolicy, key)
+	}
+	applied, err := expireKey(ctx, key, ttl, conditions, remove)
 	if err != nil {
 		return err
 	}
-	if rec != nil {
-		return writeLine(wf, ":"+strconv.FormatUint(uint64(rec.Expiration), 10))
-	}
-	return cmdTTL(wf, ctx, args)
+	return writeBool(wf, applied)
+}
+
+func cmdExpandedMapEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapExpire(wf, ctx, args, "EX")
+}
+
+func cmdExpandedMapPEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapExpire(wf, ctx, args, "PX")
+}
+
+func cmdExpandedMapEXPIREAT(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapExpire(wf, ctx, args, "EXAT")
 }
 
-func cmdExpandedMapDEL(wf io.Writer, ctx *context, args [][]byte) error {
-	key, err := formatCompositeKey(ctx, string(args[0]), MAIN_SUFFIX)
+func cmdExpandedMapPEXPIREAT(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapExpire(wf, ctx, args, "PXAT")
+}
+
+func expandedMapTTL(wf io.Writer, ctx *context, args [][]byte, unit string) error {
+	key, _, err := expandedMapExpireKey(ctx, args[0])
 	if err != nil {
 		return err
 	}
-	existed, err := ctx.client.Delete(ctx.writePolicy, key)
+	return writeTTL(wf, ctx, key, unit)
+}
+
+func cmdExpandedMapTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapTTL(wf, ctx, args, "TTL")
+}
+
+func cmdExpandedMapPTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapTTL(wf, ctx, args, "PTTL")
+}
+
+func cmdExpandedMapEXPIRETIME(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapTTL(wf, ctx, args, "EXPIRETIME")
+}
+
+func cmdExpandedMapPEXPIRETIME(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapTTL(wf, ctx, args, "PEXPIRETIME")
+}
+
+func cmdExpandedMapPERSIST(wf io.Writer, ctx *context, args [][]byte) error {
+	key, _, err := expandedMapExpireKey(ctx, args[0])
 	if err != nil {
 		return err
 	}
-	if existed {
-		if ctx.expandedMapCache != nil {
-			ctx.expandedMapCache.Del(args[0])
-		}
-		return writeLine(wf, ":1")
+	applied, err := persistKey(ctx, key)
+	if err != nil {
+		return err
 	}
-	return cmdDEL(wf, ctx, args)
+	return writeBool(wf, applied)
 }
 
 func cmdExpandedMapHMSET(wf io.Writer, ctx *context, args [][]byte) error {
@@ -233,21 +364,11 @@ func cmdExpandedMapHMSET(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
-	for i := 1; i+1 < len(args); i += 2 {
-		key, err := formatCompositeKey(ctx, *suffixedKey, string(args[i]))
-		if err != nil {
-			return err
-		}
-		rec := as.BinMap{
-			MAIN_KEY_BIN_NAME:   *suffixedKey,
-			SECOND_KEY_BIN_NAME: string(args[i]),
-			VALUE_BIN_NAME:      encode(ctx, args[i+1]),
-			"created_at":        now(),
-		}
-		err = ctx.client.Put(fillWritePolicyEx(ctx, ctx.expandedMapDefaultTTL, false), key, rec)
-		if err != nil {
-			return err
-		}
+	fields, values := parseFieldValues(args[1:])
+	ctx.batchStats["hmset"].add(len(fields))
+	_, err = expandedMapPutFields(ctx, string(args[0]), *suffixedKey, fields, values, ctx.expandedMapDefaultTTL)
+	if err != nil {
+		return err
 	}
 	return writeLine(wf, "+OK")
 }
@@ -257,67 +378,263 @@ func cmdExpandedMapHMGET(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
+	ctx.batchStats["hmget"].add(len(args) - 1)
 	res := make([]*as.Record, len(args)-1)
 	if suffixedKey != nil {
-		for i := 0; i < len(args)-1; i++ {
-			key, err := formatCompositeKey(ctx, *suffixedKey, string(args[i+1]))
-			if err != nil {
-				return err
-			}
-			rec, err := ctx.client.Get(ctx.readPolicy, key, VALUE_BIN_NAME)
-			if err != nil {
-				return err
-			}
-			res[i] = rec
+		fields := make([]string, len(args)-1)
+		for i, f := range args[1:] {
+			fields[i] = string(f)
+		}
+		res, err = expandedMapBatchGet(ctx, *suffixedKey, fields)
+		if err != nil {
+			return err
 		}
 	}
 	return writeArrayBin(wf, res, VALUE_BIN_NAME, "")
 }
 
-func cmdExpandedMapHGETALL(wf io.Writer, ctx *context, args [][]byte) error {
-	suffixedKey, err := compositeExists(ctx, string(args[0]))
-	if err != nil {
-		return err
-	}
-	if suffixedKey == nil {
-		return writeArray(wf, make([]interface{}, 0))
-	}
+// expandedMapQuery reads all the field records of a map, using the
+// secondary index on the main key bin. Used for maps without directory.
+func expandedMapQuery(ctx *context, suffixedKey string) ([]*as.Record, error) {
 	statment := as.NewStatement(ctx.ns, ctx.set)
-	statment.Addfilter(as.NewEqualFilter(MAIN_KEY_BIN_NAME, *suffixedKey))
+	statment.Addfilter(as.NewEqualFilter(MAIN_KEY_BIN_NAME, suffixedKey))
 	recordset, err := ctx.client.Query(nil, statment)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	out := make([]*as.Record, 0)
 	for res := range recordset.Results() {
 		if res.Err != nil {
-			return res.Err
+			return nil, res.Err
 		}
 		out = append(out, res.Record)
 	}
-	return writeArrayBin(wf, out, VALUE_BIN_NAME, SECOND_KEY_BIN_NAME)
+	return out, nil
 }
 
-func compositeIncr(wf io.Writer, ctx *context, suffixedKey *string, field string, value int) error {
+// expandedMapGetAll reads all the fields of a map, sorted by name
+func expandedMapGetAll(ctx *context, k []byte) ([]string, map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	suffixedKey, fields, directory, err := expandedMapDirectory(ctx, k)
+	if err != nil || suffixedKey == nil {
+		return []string{}, values, err
+	}
+	if directory {
+		out, err := expandedMapBatchGet(ctx, *suffixedKey, fields)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, rec := range out {
+			// the directory can reference a field being written or deleted
+			if rec != nil && rec.Bins[VALUE_BIN_NAME] != nil {
+				values[fields[i]] = rec.Bins[VALUE_BIN_NAME]
+			}
+		}
+		return sortedFields(values), values, nil
+	}
+	out, err := expandedMapQuery(ctx, *suffixedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, rec := range out {
+		field, ok := rec.Bins[SECOND_KEY_BIN_NAME].(string)
+		if ok && rec.Bins[VALUE_BIN_NAME] != nil {
+			values[field] = rec.Bins[VALUE_BIN_NAME]
+		}
+	}
+	return sortedFields(values), values, nil
+}
+
+func cmdExpandedMapHGETALL(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, values, err := expandedMapGetAll(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeHashAll(wf, fields, values)
+}
+
+// expandedMapGetField reads the record of a field, nil if the map or the
+// field does not exist
+func expandedMapGetField(ctx *context, k []byte, field string) (*as.Record, error) {
+	suffixedKey, err := compositeExists(ctx, string(k))
+	if err != nil || suffixedKey == nil {
+		return nil, err
+	}
 	key, err := formatCompositeKey(ctx, *suffixedKey, field)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.client.Get(ctx.readPolicy, key, VALUE_BIN_NAME)
+}
+
+func cmdExpandedMapHEXISTS(wf io.Writer, ctx *context, args [][]byte) error {
+	rec, err := expandedMapGetField(ctx, args[0], string(args[1]))
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, rec != nil && rec.Bins[VALUE_BIN_NAME] != nil)
+}
+
+func cmdExpandedMapHSTRLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	rec, err := expandedMapGetField(ctx, args[0], string(args[1]))
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		return writeLine(wf, ":0")
+	}
+	return writeStrLen(wf, rec.Bins[VALUE_BIN_NAME])
+}
+
+func cmdExpandedMapHLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, _, err := expandedMapGetAll(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(len(fields)))
+}
+
+func cmdExpandedMapHKEYS(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, _, err := expandedMapGetAll(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeHashKeys(wf, fields)
+}
+
+func cmdExpandedMapHVALS(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, values, err := expandedMapGetAll(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeHashValues(wf, fields, values)
+}
+
+func cmdExpandedMapHRANDFIELD(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, values, err := expandedMapGetAll(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeRandomFields(wf, fields, values, args[1:])
+}
+
+func cmdExpandedMapHSETNX(wf io.Writer, ctx *context, args [][]byte) error {
+	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), -1)
+	if err != nil {
+		return err
+	}
+	field := string(args[1])
+	key, err := formatCompositeKey(ctx, *suffixedKey, field)
+	if err != nil {
+		return err
+	}
+	exists, err := ctx.client.Exists(ctx.readPolicy, key)
 	if err != nil {
 		return err
 	}
-	rec, err := ctx.client.Operate(fillWritePolicyEx(ctx, ctx.expandedMapDefaultTTL, false), key, as.PutOp(as.NewBin(MAIN_KEY_BIN_NAME, *suffixedKey)), as.PutOp(as.NewBin(SECOND_KEY_BIN_NAME, field)), as.AddOp(as.NewBin(VALUE_BIN_NAME, value)), as.GetOpForBin(VALUE_BIN_NAME))
+	if exists {
+		return writeLine(wf, ":0")
+	}
+	err = expandedMapAddFields(ctx, string(args[0]), field)
+	if err != nil {
+		return err
+	}
+	rec := as.BinMap{
+		MAIN_KEY_BIN_NAME:   *suffixedKey,
+		SECOND_KEY_BIN_NAME: field,
+		VALUE_BIN_NAME:      encode(ctx, args[2]),
+		"created_at":        now(),
+	}
+	err = ctx.client.Put(fillWritePolicyEx(ctx, -1, true), key, rec)
 	if err != nil {
-		if errResultCode(err) == ase.BIN_TYPE_ERROR {
-			return writeLine(wf, "$-1")
+		if errResultCode(err) == ase.KEY_EXISTS_ERROR {
+			return writeLine(wf, ":0")
 		}
 		return err
 	}
-	return writeBinInt(wf, rec, VALUE_BIN_NAME)
+	err = expandedMapAddFields(ctx, string(args[0]), field)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":1")
 }
 
-func cmdExpandedMapHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
-	incr, err := strconv.Atoi(string(args[2]))
+// expandedMapIncr adds incr, an int64 or a float64, to a field of the map k.
+// An existing field record is incremented natively, and keeps its TTL, which
+// may have been set by HEXPIRE, and its expiration bin. A new one gets the
+// default TTL, and is added to the directory before and after being written.
+func expandedMapIncr(ctx *context, k string, suffixedKey string, field string, incr interface{}) (interface{}, string, error) {
+	key, err := formatCompositeKey(ctx, suffixedKey, field)
+	if err != nil {
+		return nil, "", err
+	}
+	policy := fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY)
+	var next func(current interface{}) (interface{}, string)
+	switch v := incr.(type) {
+	case int64:
+		results, ok, err := addToBins(ctx, policy, key, []string{VALUE_BIN_NAME}, []int64{v})
+		if err != nil {
+			return nil, "", err
+		}
+		if ok {
+			return results[0], "", nil
+		}
+		next = intIncrement(v)
+	case float64:
+		result, ok, err := addFloatToBin(ctx, policy, key, VALUE_BIN_NAME, v)
+		if err != nil || ok {
+			return result, "", err
+		}
+		next = floatIncrement(v)
+	}
+	prepare := func(rec *as.Record) (int, error) {
+		if rec != nil {
+			return ttlDontUpdate, nil
+		}
+		return ctx.expandedMapDefaultTTL, expandedMapAddFields(ctx, k, field)
+	}
+	result, reply, created, err := incrementBin(ctx, key, VALUE_BIN_NAME, prepare, next, as.PutOp(as.NewBin(MAIN_KEY_BIN_NAME, suffixedKey)), as.PutOp(as.NewBin(SECOND_KEY_BIN_NAME, field)))
+	if err == nil && created {
+		err = expandedMapAddFields(ctx, k, field)
+	}
+	return result, reply, err
+}
+
+func compositeIncr(wf io.Writer, ctx *context, k string, suffixedKey *string, field string, value int64) error {
+	result, reply, err := expandedMapIncr(ctx, k, *suffixedKey, field, value)
 	if err != nil {
 		return err
 	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeIncrResult(wf, result.(int64), "")
+}
+
+func cmdExpandedMapHINCRBYFLOAT(wf io.Writer, ctx *context, args [][]byte) error {
+	incr, ok := parseFloat(args[2])
+	if !ok {
+		return writeErrorReply(wf, "ERR value is not a valid float")
+	}
+	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), -1)
+	if err != nil {
+		return err
+	}
+	result, reply, err := expandedMapIncr(ctx, string(args[0]), *suffixedKey, string(args[1]), incr)
+	if err != nil {
+		return err
+	}
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return writeByteArray(wf, []byte(formatFloat(result.(float64))))
+}
+
+func cmdExpandedMapHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
+	incr, ok := parseInt(args[2])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
 	ttl, err := strconv.Atoi(string(args[3]))
 	if err != nil {
 		return err
@@ -326,45 +643,85 @@ func cmdExpandedMapHINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
 	if err != nil {
 		return err
 	}
-	return compositeIncr(wf, ctx, suffixedKey, string(args[1]), incr)
+	return compositeIncr(wf, ctx, string(args[0]), suffixedKey, string(args[1]), incr)
 }
 
 func cmdExpandedMapHINCRBY(wf io.Writer, ctx *context, args [][]byte) error {
-	incr, err := strconv.Atoi(string(args[2]))
-	if err != nil {
-		return err
+	incr, ok := parseInt(args[2])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
 	}
 	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), -1)
 	if err != nil {
 		return err
 	}
-	return compositeIncr(wf, ctx, suffixedKey, string(args[1]), incr)
+	return compositeIncr(wf, ctx, string(args[0]), suffixedKey, string(args[1]), incr)
 }
 
+// errIncrReplied stops the increments of hmincrbyex after an error reply
+var errIncrReplied = errors.New("increment replied an error")
+
 func cmdExpandedMapHMINCRBYEX(wf io.Writer, ctx *context, args [][]byte) error {
 	ttl, err := strconv.Atoi(string(args[1]))
 	if err != nil {
 		return err
 	}
+	a := args[2:]
+	fields := make([]string, 0, len(a)/2)
+	incrs := make(map[string]int64)
+	for i := 0; i+1 < len(a); i += 2 {
+		incr, ok := parseInt(a[i+1])
+		if !ok {
+			return writeErrorReply(wf, errNotInteger)
+		}
+		field := string(a[i])
+		if _, ok := incrs[field]; !ok {
+			fields = append(fields, field)
+		}
+		// a field given twice is incremented once by the sum, like the
+		// standard implementation
+		incrs[field] += incr
+	}
 	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(args[0]), ttl)
 	if err != nil {
 		return err
 	}
-	if len(args) > 2 {
-		a := args[2:]
-		for i := 0; i+1 < len(a); i += 2 {
-			incr, err := strconv.Atoi(string(a[i+1]))
-			if err != nil {
-				return err
-			}
-			key, err := formatCompositeKey(ctx, *suffixedKey, string(a[i]))
-			if err != nil {
-				return err
-			}
-			_, err = ctx.client.Operate(fillWritePolicyEx(ctx, ctx.expandedMapDefaultTTL, false), key, as.PutOp(as.NewBin(MAIN_KEY_BIN_NAME, *suffixedKey)), as.PutOp(as.NewBin(SECOND_KEY_BIN_NAME, string(a[i]))), as.AddOp(as.NewBin(VALUE_BIN_NAME, incr)))
-			if err != nil {
-				return err
-			}
+	// fields are incremented one by one, so all of them are checked first:
+	// the map is left unchanged if one is not an integer or would overflow.
+	// A concurrent write between the check and the increments can still make
+	// an increment fail after others were applied: the error is replied, and
+	// the applied increments are kept
+	current, err := expandedMapBatchGet(ctx, *suffixedKey, fields)
+	if err != nil {
+		return err
+	}
+	for i, rec := range current {
+		var v interface{}
+		if rec != nil {
+			v = rec.Bins[VALUE_BIN_NAME]
+		}
+		if _, reply := intIncrement(incrs[fields[i]])(v); reply != "" {
+			return writeErrorReply(wf, reply)
+		}
+	}
+	ctx.batchStats["hmincrbyex"].add(len(fields))
+	replies := make([]string, len(fields))
+	err = forEachBounded(len(fields), ctx.batchConcurrency, func(i int) error {
+		field := fields[i]
+		_, reply, err := expandedMapIncr(ctx, string(args[0]), *suffixedKey, field, incrs[field])
+		if err == nil && reply != "" {
+			// no other increment is started after an error reply
+			replies[i] = reply
+			return errIncrReplied
+		}
+		return err
+	})
+	if err != nil && err != errIncrReplied {
+		return err
+	}
+	for _, reply := range replies {
+		if reply != "" {
+			return writeErrorReply(wf, reply)
 		}
 	}
 	return writeLine(wf, "+OK")
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/coocood/freecache"
+)
+
+// Expanded map cache, mapping the key of a map to its suffixed key. Maps
+// which do not exist are cached too, with an empty suffixed key, for
+// negativeTTL seconds. Listeners using the same namespace and set share the
+// same cache.
+
+type expandedMapCache struct {
+	// evictions already sent to statsd, first for 64 bits alignment
+	evictions    int64
+	cache        *freecache.Cache
+	ttl          int
+	negativeTTL  int
+	hits         uint32
+	negativeHits uint32
+	misses       uint32
+}
+
+// caches by namespace and set
+var expandedMapCaches = make(map[string]*expandedMapCache)
+
+// sharedExpandedMapCache returns the cache of the namespace and the set,
+// created with the configuration of the first listener
+func sharedExpandedMapCache(ns string, set string, size int, ttl int, negativeTTL int) *expandedMapCache {
+	name := ns + "." + set
+	if c := expandedMapCaches[name]; c != nil {
+		log.Printf("%s: Sharing the cache of %s", set, name)
+		return c
+	}
+	c := &expandedMapCache{
+		cache:       freecache.NewCache(size),
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+	expandedMapCaches[name] = c
+	log.Printf("%s: Using a cache of %d bytes, ttl %d, negative ttl %d", set, size, ttl, negativeTTL)
+	return c
+}
+
+// sendStats sends the hits, misses and evictions since the last call
+func (c *expandedMapCache) sendStats(conn *net.UDPConn, prefix string) {
+	hits := atomic.SwapUint32(&c.hits, 0)
+	negativeHits := atomic.SwapUint32(&c.negativeHits, 0)
+	misses := atomic.SwapUint32(&c.misses, 0)
+	total := c.cache.EvacuateCount()
+	evictions := total - atomic.SwapInt64(&c.evictions, total)
+	udpSend(conn, prefix+"cache.hit:"+strconv.Itoa(int(hits))+"|c")
+	udpSend(conn, prefix+"cache.negative_hit:"+strconv.Itoa(int(negativeHits))+"|c")
+	udpSend(conn, prefix+"cache.miss:"+strconv.Itoa(int(misses))+"|c")
+	udpSend(conn, prefix+"cache.eviction:"+strconv.FormatInt(evictions, 10)+"|c")
+}
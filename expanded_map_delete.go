@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io"
+	"log"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// Deletion of expanded maps.
+// The main record is removed first, so the map does not exist anymore for
+// readers. The field records are listed by the field directory, or found
+// through the secondary index on the main key bin for maps without directory.
+// Up to expandedMapDelSyncLimit of them are removed before replying, the
+// others by a background worker reading a queue of deletions.
+
+type expandedMapDeletion struct {
+	suffixedKey string
+	// nil for maps without directory
+	fields []string
+}
+
+// expandedMapDeleteFields removes the field records of a map, listed by
+// fields, or found by the secondary index if fields is nil. It stops after
+// limit records if limit is positive, and returns false if some may remain.
+func expandedMapDeleteFields(ctx *context, d expandedMapDeletion, limit int) (bool, error) {
+	if d.fields != nil {
+		for i, f := range d.fields {
+			if limit > 0 && i >= limit {
+				return false, nil
+			}
+			key, err := formatCompositeKey(ctx, d.suffixedKey, f)
+			if err != nil {
+				return false, err
+			}
+			_, err = ctx.client.Delete(ctx.writePolicy, key)
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	statment := as.NewStatement(ctx.ns, ctx.set, MAIN_KEY_BIN_NAME)
+	statment.Addfilter(as.NewEqualFilter(MAIN_KEY_BIN_NAME, d.suffixedKey))
+	recordset, err := ctx.client.Query(nil, statment)
+	if err != nil {
+		return false, err
+	}
+	defer recordset.Close()
+	deleted := 0
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return false, res.Err
+		}
+		if limit > 0 && deleted >= limit {
+			return false, nil
+		}
+		_, err := ctx.client.Delete(ctx.writePolicy, res.Record.Key)
+		if err != nil {
+			return false, err
+		}
+		deleted++
+	}
+	return true, nil
+}
+
+// expandedMapEnqueueDelete gives the field records of a map to the
+// background worker. If the queue is full, they will expire with their TTL.
+func expandedMapEnqueueDelete(ctx *context, d expandedMapDeletion) {
+	select {
+	case ctx.expandedMapDeleteQueue <- d:
+	default:
+		log.Printf("%s: deletion queue is full, fields of %s will expire with their TTL", ctx.set, d.suffixedKey)
+	}
+}
+
+func expandedMapDeleteWorker(ctx *context) {
+	for d := range ctx.expandedMapDeleteQueue {
+		_, err := expandedMapDeleteFields(ctx, d, 0)
+		if err != nil {
+			log.Printf("%s: unable to delete fields of %s: %s", ctx.set, d.suffixedKey, err)
+		}
+	}
+}
+
+// expandedMapDelete removes an expanded map. async always uses the
+// background worker to remove the field records. Returns true if the map
+// existed.
+func expandedMapDelete(ctx *context, k []byte, async bool) (bool, error) {
+	suffixedKey, fields, directory, err := expandedMapDirectory(ctx, k)
+	if err != nil || suffixedKey == nil {
+		return false, err
+	}
+	key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+	if err != nil {
+		return false, err
+	}
+	existed, err := ctx.client.Delete(ctx.writePolicy, key)
+	if err != nil {
+		return false, err
+	}
+	cacheDel(ctx, string(k))
+	cacheNotifyPeers(ctx, "delete", string(k))
+	if !existed {
+		return false, nil
+	}
+	d := expandedMapDeletion{suffixedKey: *suffixedKey}
+	if directory {
+		d.fields = fields
+	}
+	if async {
+		expandedMapEnqueueDelete(ctx, d)
+		return true, nil
+	}
+	complete, err := expandedMapDeleteFields(ctx, d, ctx.expandedMapDelSyncLimit)
+	if err != nil {
+		log.Printf("%s: unable to delete fields of %s: %s", ctx.set, d.suffixedKey, err)
+	}
+	if !complete {
+		expandedMapEnqueueDelete(ctx, d)
+	}
+	return true, nil
+}
+
+func expandedMapDel(wf io.Writer, ctx *context, args [][]byte, async bool) error {
+	existed, err := expandedMapDelete(ctx, args[0], async)
+	if err != nil {
+		return err
+	}
+	if existed {
+		return writeLine(wf, ":1")
+	}
+	return cmdDEL(wf, ctx, args)
+}
+
+func cmdExpandedMapDEL(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapDel(wf, ctx, args, false)
+}
+
+func cmdExpandedMapUNLINK(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapDel(wf, ctx, args, true)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Field directory of expanded maps.
+// The main record holds the names of the fields in the map bin FIELDS_BIN_NAME.
+// A field is added to the directory before its record is created, and again
+// after, so a name removed in the meantime comes back. A name is removed only
+// if the field record does not exist, checked under the generation of the
+// main record, so the directory holds at least all the existing fields.
+// Main records created by previous versions have no DIRECTORY_BIN_NAME
+// marker: their fields are found with the secondary index. A directory
+// holding more than expandedMapDirectoryLimit fields, or too large for the
+// main record, is dropped, and the map uses the secondary index too.
+
+const FIELDS_BIN_NAME = "f"
+const DIRECTORY_BIN_NAME = "d"
+
+var expandedMapDirectoryPolicy = as.NewMapPolicy(as.MapOrder.KEY_ORDERED, as.MapWriteMode.UPDATE)
+
+// expandedMapAddFields adds fields to the directory of the map k
+func expandedMapAddFields(ctx *context, k string, fields ...string) error {
+	key, err := formatCompositeKey(ctx, k, MAIN_SUFFIX)
+	if err != nil {
+		return err
+	}
+	items := make(map[interface{}]interface{})
+	for _, f := range fields {
+		items[f] = 1
+	}
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY), key, as.MapPutItemsOp(expandedMapDirectoryPolicy, FIELDS_BIN_NAME, items), as.GetOpForBin(DIRECTORY_BIN_NAME))
+	switch errResultCode(err) {
+	case ase.KEY_NOT_FOUND_ERROR:
+		// the map has been deleted in the meantime
+		return nil
+	case ase.RECORD_TOO_BIG:
+		return expandedMapDropDirectory(ctx, key)
+	}
+	if err != nil {
+		return err
+	}
+	size, _ := rec.Bins[FIELDS_BIN_NAME].(int)
+	if rec.Bins[DIRECTORY_BIN_NAME] == nil || ctx.expandedMapDirectoryLimit > 0 && size > ctx.expandedMapDirectoryLimit {
+		return expandedMapDropDirectory(ctx, key)
+	}
+	return nil
+}
+
+// expandedMapDropDirectory removes the directory of a map, whose fields are
+// then found with the secondary index
+func expandedMapDropDirectory(ctx *context, key *as.Key) error {
+	_, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttlDontUpdate, as.UPDATE_ONLY), key, as.PutOp(as.NewBin(DIRECTORY_BIN_NAME, nil)), as.PutOp(as.NewBin(FIELDS_BIN_NAME, nil)))
+	if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+		return nil
+	}
+	return err
+}
+
+// expandedMapRemoveFields removes from the directory of the map k the fields
+// whose record does not exist anymore. A command creating one of them in the
+// meantime adds it again to the directory, which fails the removal, and the
+// records are checked again.
+func expandedMapRemoveFields(ctx *context, k string, fields ...string) error {
+	key, err := formatCompositeKey(ctx, k, MAIN_SUFFIX)
+	if err != nil {
+		return err
+	}
+	return casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key, ROOT_BIN_NAME, DIRECTORY_BIN_NAME)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Bins[DIRECTORY_BIN_NAME] == nil {
+			return nil
+		}
+		suffixedKey, _ := rec.Bins[ROOT_BIN_NAME].(string)
+		fieldKeys := make([]*as.Key, len(fields))
+		for i, f := range fields {
+			fieldKeys[i], err = formatCompositeKey(ctx, suffixedKey, f)
+			if err != nil {
+				return err
+			}
+		}
+		exists, err := ctx.client.BatchExists(ctx.readPolicy, fieldKeys)
+		if err != nil {
+			return err
+		}
+		gone := make([]interface{}, 0, len(fields))
+		for i, f := range fields {
+			if !exists[i] {
+				gone = append(gone, f)
+			}
+		}
+		if len(gone) == 0 {
+			return nil
+		}
+		policy := fillWritePolicyCas(ctx, ttlDontUpdate, rec)
+		policy.RecordExistsAction = as.UPDATE_ONLY
+		_, err = ctx.client.Operate(policy, key, as.MapRemoveByKeyListOp(FIELDS_BIN_NAME, gone, as.MapReturnType.NONE))
+		code := errResultCode(err)
+		if code == ase.KEY_NOT_FOUND_ERROR || code == ase.BIN_NOT_FOUND {
+			return nil
+		}
+		return err
+	})
+}
+
+// expandedMapDirectory reads the main record of the map k. Returns its
+// suffixed key, nil if the map does not exist, and its fields, if the map has
+// a directory.
+func expandedMapDirectory(ctx *context, k []byte) (*string, []string, bool, error) {
+	key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	rec, err := ctx.client.Get(ctx.readPolicy, key, ROOT_BIN_NAME, DIRECTORY_BIN_NAME, FIELDS_BIN_NAME)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if rec == nil || rec.Bins[ROOT_BIN_NAME] == nil {
+		return nil, nil, false, nil
+	}
+	suffixedKey := rec.Bins[ROOT_BIN_NAME].(string)
+	if rec.Bins[DIRECTORY_BIN_NAME] == nil {
+		return &suffixedKey, nil, false, nil
+	}
+	m, _ := rec.Bins[FIELDS_BIN_NAME].(map[interface{}]interface{})
+	fields := make([]string, 0, len(m))
+	for f := range m {
+		if s, ok := f.(string); ok {
+			fields = append(fields, s)
+		}
+	}
+	return &suffixedKey, fields, true, nil
+}
+
+// expandedMapBatchGet reads the field records of a map in a single batch
+func expandedMapBatchGet(ctx *context, suffixedKey string, fields []string) ([]*as.Record, error) {
+	if len(fields) == 0 {
+		return []*as.Record{}, nil
+	}
+	keys := make([]*as.Key, len(fields))
+	for i, f := range fields {
+		key, err := formatCompositeKey(ctx, suffixedKey, f)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = key
+	}
+	return ctx.client.BatchGet(ctx.readPolicy, keys, VALUE_BIN_NAME)
+}
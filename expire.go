@@ -0,0 +1,262 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// expireTTL converts a relative (EX / PX) or absolute (EXAT / PXAT)
+// expiration to a TTL in seconds. Aerospike TTLs are in seconds, so
+// milliseconds are rounded up. Returns false if the TTL is above the max TTL
+// of Aerospike.
+func expireTTL(option string, v int64) (int, bool) {
+	ttl := v
+	switch option {
+	case "PX":
+		ttl = ceilDiv(v, 1000)
+	case "EXAT":
+		ttl = v - time.Now().Unix()
+	case "PXAT":
+		ttl = ceilDiv(v-time.Now().UnixNano()/int64(time.Millisecond), 1000)
+	}
+	// the server refuses larger TTLs
+	if ttl > maxTTL {
+		return 0, false
+	}
+	return int(ttl), true
+}
+
+func ceilDiv(a int64, b int64) int64 {
+	if a > 0 && a%b != 0 {
+		return a/b + 1
+	}
+	return a / b
+}
+
+// Commands of the EXPIRE family, by option
+var expireCommandNames = map[string]string{"EX": "expire", "PX": "pexpire", "EXAT": "expireat", "PXAT": "pexpireat"}
+
+// parseExpireArgs parses the arguments of the EXPIRE family: key, time, and
+// NX / XX / GT / LT conditions. Returns an error reply if they are invalid.
+func parseExpireArgs(args [][]byte, option string) (int, []string, string) {
+	v, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, nil, "ERR value is not an integer or out of range"
+	}
+	conditions := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, a := range args[2:] {
+		c := strings.ToUpper(string(a))
+		switch c {
+		case "NX", "XX", "GT", "LT":
+		default:
+			return 0, nil, "ERR Unsupported option " + string(a)
+		}
+		seen[c] = true
+		conditions = append(conditions, c)
+	}
+	if seen["NX"] && (seen["XX"] || seen["GT"] || seen["LT"]) {
+		return 0, nil, "ERR NX and XX, GT or LT options at the same time are not compatible"
+	}
+	if seen["GT"] && seen["LT"] {
+		return 0, nil, "ERR GT and LT options at the same time are not compatible"
+	}
+	ttl, ok := expireTTL(option, v)
+	if !ok {
+		return 0, nil, "ERR invalid expire time in '" + expireCommandNames[option] + "' command"
+	}
+	return ttl, conditions, ""
+}
+
+// expireConditionMet checks a NX / XX / GT / LT condition against the
+// current TTL of the key, -1 meaning no expiration
+func expireConditionMet(condition string, current int64, ttl int) bool {
+	switch condition {
+	case "NX":
+		return current == -1
+	case "XX":
+		return current != -1
+	case "GT":
+		return current != -1 && int64(ttl) > current
+	case "LT":
+		return current == -1 || int64(ttl) < current
+	}
+	return true
+}
+
+// recordTTL returns the TTL of the record in seconds, -1 if the record never
+// expires, -2 if it does not exist
+func recordTTL(ctx *context, key *as.Key) (*as.Record, int64, error) {
+	rec, err := ctx.client.GetHeader(ctx.readPolicy, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec == nil {
+		return nil, -2, nil
+	}
+	if rec.Expiration == ttlNeverExpire {
+		return rec, -1, nil
+	}
+	return rec, int64(rec.Expiration), nil
+}
+
+// expireKey sets the TTL of the record if all conditions are met. A negative
+// or zero TTL calls remove. Returns true if the TTL has been applied.
+func expireKey(ctx *context, key *as.Key, ttl int, conditions []string, remove func() (bool, error)) (bool, error) {
+	if len(conditions) == 0 {
+		if ttl <= 0 {
+			return remove()
+		}
+		err := ctx.client.Touch(fillWritePolicyEx(ctx, ttl, false), key)
+		if err != nil {
+			if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+	applied := false
+	err := casRetry(func() error {
+		rec, current, err := recordTTL(ctx, key)
+		if err != nil {
+			return err
+		}
+		applied = current != -2
+		for _, c := range conditions {
+			applied = applied && expireConditionMet(c, current, ttl)
+		}
+		if !applied {
+			return nil
+		}
+		if ttl <= 0 {
+			applied, err = remove()
+			return err
+		}
+		err = ctx.client.Touch(fillWritePolicyCas(ctx, ttl, rec), key)
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			applied = false
+			return nil
+		}
+		return err
+	})
+	return applied, err
+}
+
+// persistKey removes the TTL of the record. Returns true if the record had one.
+func persistKey(ctx *context, key *as.Key) (bool, error) {
+	applied := false
+	err := casRetry(func() error {
+		rec, current, err := recordTTL(ctx, key)
+		if err != nil {
+			return err
+		}
+		applied = current >= 0
+		if !applied {
+			return nil
+		}
+		err = ctx.client.Touch(fillWritePolicyCas(ctx, ttlNeverExpire, rec), key)
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			applied = false
+			return nil
+		}
+		return err
+	})
+	return applied, err
+}
+
+// writeTTL sends the TTL of the record, in seconds (TTL) or milliseconds
+// (PTTL), or its expiration time as an unix timestamp in seconds (EXPIRETIME)
+// or milliseconds (PEXPIRETIME)
+func writeTTL(wf io.Writer, ctx *context, key *as.Key, unit string) error {
+	_, ttl, err := recordTTL(ctx, key)
+	if err != nil {
+		return err
+	}
+	if ttl >= 0 {
+		switch unit {
+		case "PTTL":
+			ttl *= 1000
+		case "EXPIRETIME":
+			ttl += time.Now().Unix()
+		case "PEXPIRETIME":
+			ttl = time.Now().UnixNano()/int64(time.Millisecond) + ttl*1000
+		}
+	}
+	return writeLine(wf, ":"+strconv.FormatInt(ttl, 10))
+}
+
+func expireCommand(wf io.Writer, ctx *context, args [][]byte, option string) error {
+	ttl, conditions, reply := parseExpireArgs(args, option)
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	applied, err := expireKey(ctx, key, ttl, conditions, func() (bool, error) {
+		return ctx.client.Delete(ctx.writePolicy, key)
+	})
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, applied)
+}
+
+func cmdEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expireCommand(wf, ctx, args, "EX")
+}
+
+func cmdPEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expireCommand(wf, ctx, args, "PX")
+}
+
+func cmdEXPIREAT(wf io.Writer, ctx *context, args [][]byte) error {
+	return expireCommand(wf, ctx, args, "EXAT")
+}
+
+func cmdPEXPIREAT(wf io.Writer, ctx *context, args [][]byte) error {
+	return expireCommand(wf, ctx, args, "PXAT")
+}
+
+func ttlCommand(wf io.Writer, ctx *context, args [][]byte, unit string) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return writeTTL(wf, ctx, key, unit)
+}
+
+func cmdTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return ttlCommand(wf, ctx, args, "TTL")
+}
+
+func cmdPTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return ttlCommand(wf, ctx, args, "PTTL")
+}
+
+func cmdEXPIRETIME(wf io.Writer, ctx *context, args [][]byte) error {
+	return ttlCommand(wf, ctx, args, "EXPIRETIME")
+}
+
+func cmdPEXPIRETIME(wf io.Writer, ctx *context, args [][]byte) error {
+	return ttlCommand(wf, ctx, args, "PEXPIRETIME")
+}
+
+func cmdPERSIST(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	applied, err := persistKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, applied)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// Garbage collection of expanded maps.
+// Field records whose main record does not exist anymore, or has been
+// recreated with another suffixed key, are orphans: they are not reachable,
+// and stay until their TTL. The garbage collector scans the set, checks the
+// main record of each suffixed key found in the m bin, and deletes orphans.
+// Field records younger than --min_age (default gcMinAge) are skipped: a
+// migration or a spill writes them before creating the main record.
+// Usage: aerodis --config_file config.json gc [--set set] [--dry_run] [--rate 100] [--min_age 600]
+
+// Max number of suffixed keys whose state is remembered during a scan
+const gcCacheSize = 100000
+
+// Default min age of the field records checked by the garbage collector
+const gcMinAge = 600 * time.Second
+
+type gcStats struct {
+	scanned    int
+	orphanMaps int
+	orphans    int
+	deleted    int
+}
+
+// expandedMapAlive returns true if the main record of the map still uses
+// this suffixed key
+func expandedMapAlive(ctx *context, suffixedKey string) (bool, error) {
+	// the suffixed key is the key of the map, "_" and 8 random chars
+	if len(suffixedKey) < 9 {
+		return false, nil
+	}
+	key, err := formatCompositeKey(ctx, suffixedKey[:len(suffixedKey)-9], MAIN_SUFFIX)
+	if err != nil {
+		return false, err
+	}
+	rec, err := ctx.client.Get(ctx.readPolicy, key, ROOT_BIN_NAME)
+	if err != nil {
+		return false, err
+	}
+	return rec != nil && rec.Bins[ROOT_BIN_NAME] == suffixedKey, nil
+}
+
+// expandedMapGC deletes the orphan field records of the set, at most rate
+// per second if rate is positive, skipping the field records younger than
+// minAge. In dry run mode, orphans are only counted.
+func expandedMapGC(ctx *context, dryRun bool, rate int, minAge time.Duration) (gcStats, error) {
+	stats := gcStats{}
+	var throttle <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	recordset, err := ctx.client.ScanAll(as.NewScanPolicy(), ctx.ns, ctx.set, MAIN_KEY_BIN_NAME, "created_at")
+	if err != nil {
+		return stats, err
+	}
+	defer recordset.Close()
+	alive := make(map[string]bool)
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return stats, res.Err
+		}
+		suffixedKey, ok := res.Record.Bins[MAIN_KEY_BIN_NAME].(string)
+		if !ok {
+			// not a field record
+			continue
+		}
+		stats.scanned++
+		// created_at holds now(), in nanoseconds
+		createdAt, _ := res.Record.Bins["created_at"].(int)
+		if now()-int64(createdAt) < int64(minAge) {
+			continue
+		}
+		a, known := alive[suffixedKey]
+		if !known {
+			a, err = expandedMapAlive(ctx, suffixedKey)
+			if err != nil {
+				return stats, err
+			}
+			if len(alive) >= gcCacheSize {
+				alive = make(map[string]bool)
+			}
+			alive[suffixedKey] = a
+			if !a {
+				stats.orphanMaps++
+				if dryRun {
+					log.Printf("%s: orphan fields for %s", ctx.set, suffixedKey)
+				}
+			}
+		}
+		if a {
+			continue
+		}
+		stats.orphans++
+		if dryRun {
+			continue
+		}
+		if throttle != nil {
+			<-throttle
+		}
+		existed, err := ctx.client.Delete(ctx.writePolicy, res.Record.Key)
+		if err != nil {
+			return stats, err
+		}
+		if existed {
+			stats.deleted++
+		}
+	}
+	return stats, nil
+}
+
+// gcMain runs the gc subcommand on the expanded and hybrid map sets of the
+// configuration
+func gcMain(client *as.Client, ns string, readPolicy *as.BasePolicy, writePolicy *as.WritePolicy, sets []interface{}, args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	onlySet := flags.String("set", "", "Set to collect, default all expanded and hybrid map sets")
+	dryRun := flags.Bool("dry_run", false, "Report orphans without deleting them")
+	rate := flags.Int("rate", 100, "Max deletions per second, 0 for no limit")
+	minAge := flags.Int("min_age", int(gcMinAge/time.Second), "Min age in seconds of the field records to collect")
+	flags.Parse(args)
+
+	for _, c := range sets {
+		m := c.(map[string]interface{})
+		set := m["set"].(string)
+		if *onlySet != "" && set != *onlySet {
+			continue
+		}
+		mapMode := setMapMode(m)
+		if *onlySet == "" && mapMode != "expanded" && mapMode != "hybrid" {
+			continue
+		}
+		ctx := context{
+			client:      client,
+			ns:          ns,
+			set:         set,
+			readPolicy:  readPolicy,
+			writePolicy: writePolicy,
+		}
+		log.Printf("%s: Collecting orphan fields, dry run %t, rate %d, min age %ds", set, *dryRun, *rate, *minAge)
+		stats, err := expandedMapGC(&ctx, *dryRun, *rate, time.Duration(*minAge)*time.Second)
+		log.Printf("%s: %d field records scanned, %d orphan records of %d maps, %d deleted", set, stats.scanned, stats.orphans, stats.orphanMaps, stats.deleted)
+		if err != nil {
+			log.Fatalf("%s: Garbage collection failed: %s", set, err)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// Handler tests, run against the Aerospike server of AEROSPIKE_HOST, in the
+// namespace AEROSPIKE_NS (default test). They are skipped without it.
+
+const maxInt64 = "9223372036854775807"
+
+func testContext(t *testing.T, mapMode string) *context {
+	host := os.Getenv("AEROSPIKE_HOST")
+	if host == "" {
+		t.Skip("AEROSPIKE_HOST is not set")
+	}
+	ns := os.Getenv("AEROSPIKE_NS")
+	if ns == "" {
+		ns = "test"
+	}
+	client, err := as.NewClient(host, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readPolicy := as.NewPolicy()
+	fillReadPolicy(readPolicy)
+	writePolicy := as.NewWritePolicy(0, 0)
+	fillWritePolicy(writePolicy)
+	ctx := &context{
+		client:                  client,
+		ns:                      ns,
+		set:                     "handlers_test_" + mapMode,
+		readPolicy:              readPolicy,
+		writePolicy:             writePolicy,
+		mapMode:                 mapMode,
+		batchStats:              newBatchStats(),
+		batchConcurrency:        16,
+		listWaiters:             newListWaiters(),
+		blockingPollMin:         10 * time.Millisecond,
+		blockingPollMax:         100 * time.Millisecond,
+		expandedMapDefaultTTL:   3600,
+		expandedMapDeleteQueue:  make(chan expandedMapDeletion, 100),
+		expandedMapDelSyncLimit: 100,
+	}
+	return ctx
+}
+
+func testHandlers(mapMode string) map[string]handler {
+	switch mapMode {
+	case "expanded":
+		return expandedMapHandlers()
+	case "cdt":
+		return cdtMapHandlers()
+	case "hybrid":
+		return hybridMapHandlers()
+	}
+	return standardHandlers()
+}
+
+// run calls the handler of a command, and returns its reply
+func run(t *testing.T, ctx *context, handlers map[string]handler, args ...string) string {
+	h, ok := handlers[args[0]]
+	if !ok {
+		t.Fatalf("unknown command %s", args[0])
+	}
+	a := make([][]byte, len(args)-1)
+	for i, arg := range args[1:] {
+		a[i] = []byte(arg)
+	}
+	buf := bytes.NewBuffer(nil)
+	err := h.f(buf, ctx, a)
+	if err != nil {
+		t.Fatalf("%v: %s", args, err)
+	}
+	return buf.String()
+}
+
+func expect(t *testing.T, ctx *context, handlers map[string]handler, reply string, args ...string) {
+	got := run(t, ctx, handlers, args...)
+	if got != reply {
+		t.Errorf("%s %v: got %q, expected %q", ctx.mapMode, args, got, reply)
+	}
+}
+
+func TestIncrByOverflow(t *testing.T) {
+	ctx := testContext(t, "standard")
+	h := testHandlers("standard")
+	run(t, ctx, h, "DEL", "incrKey")
+	expect(t, ctx, h, ":"+maxInt64+"\r\n", "INCRBY", "incrKey", maxInt64)
+	expect(t, ctx, h, "-"+errOverflow+"\r\n", "INCRBY", "incrKey", "1")
+	expect(t, ctx, h, "$19\r\n"+maxInt64+"\r\n", "GET", "incrKey")
+	expect(t, ctx, h, ":1\r\n", "DEL", "incrKey")
+}
+
+func TestHIncrByOverflow(t *testing.T) {
+	for _, mapMode := range []string{"standard", "expanded", "cdt"} {
+		ctx := testContext(t, mapMode)
+		h := testHandlers(mapMode)
+		run(t, ctx, h, "DEL", "hincrKey")
+		expect(t, ctx, h, ":"+maxInt64+"\r\n", "HINCRBY", "hincrKey", "a", maxInt64)
+		expect(t, ctx, h, "-"+errOverflow+"\r\n", "HINCRBY", "hincrKey", "a", "1")
+		expect(t, ctx, h, "$19\r\n"+maxInt64+"\r\n", "HGET", "hincrKey", "a")
+		expect(t, ctx, h, ":1\r\n", "HSET", "hincrKey", "b", "x")
+		expect(t, ctx, h, "-"+errNotInteger+"\r\n", "HINCRBY", "hincrKey", "b", "1")
+		run(t, ctx, h, "DEL", "hincrKey")
+	}
+}
+
+// A failed HMINCRBYEX leaves all the fields unchanged
+func TestHMIncrByExAtomic(t *testing.T) {
+	for _, mapMode := range []string{"standard", "expanded", "cdt"} {
+		ctx := testContext(t, mapMode)
+		h := testHandlers(mapMode)
+		run(t, ctx, h, "DEL", "hmincrKey")
+		expect(t, ctx, h, ":2\r\n", "HSET", "hmincrKey", "a", maxInt64, "b", "12")
+		expect(t, ctx, h, "-"+errOverflow+"\r\n", "HMINCRBYEX", "hmincrKey", "100", "b", "2", "a", "1")
+		expect(t, ctx, h, "$2\r\n12\r\n", "HGET", "hmincrKey", "b")
+		expect(t, ctx, h, "+OK\r\n", "HMINCRBYEX", "hmincrKey", "100", "b", "2", "c", "-3", "b", "1")
+		expect(t, ctx, h, "$2\r\n15\r\n", "HGET", "hmincrKey", "b")
+		expect(t, ctx, h, "$2\r\n-3\r\n", "HGET", "hmincrKey", "c")
+		run(t, ctx, h, "DEL", "hmincrKey")
+	}
+}
+
+// Increments keep the expiration of an expanded map field
+func TestExpandedIncrKeepsFieldTTL(t *testing.T) {
+	ctx := testContext(t, "expanded")
+	h := testHandlers("expanded")
+	run(t, ctx, h, "DEL", "fieldTTLKey")
+	expect(t, ctx, h, ":1\r\n", "HINCRBY", "fieldTTLKey", "a", "1")
+	expect(t, ctx, h, "*1\r\n:1\r\n", "HEXPIRE", "fieldTTLKey", "100", "FIELDS", "1", "a")
+	expect(t, ctx, h, ":2\r\n", "HINCRBY", "fieldTTLKey", "a", "1")
+	expect(t, ctx, h, "$3\r\n2.5\r\n", "HINCRBYFLOAT", "fieldTTLKey", "a", "0.5")
+	reply := run(t, ctx, h, "HTTL", "fieldTTLKey", "FIELDS", "1", "a")
+	if reply == "*1\r\n:-1\r\n" || reply == "*1\r\n:-2\r\n" {
+		t.Errorf("HTTL after increments: got %q, expected the TTL set by HEXPIRE", reply)
+	}
+	run(t, ctx, h, "DEL", "fieldTTLKey")
+}
+
+// The directory lists a field deleted then written again
+func TestExpandedDirectory(t *testing.T) {
+	ctx := testContext(t, "expanded")
+	h := testHandlers("expanded")
+	run(t, ctx, h, "DEL", "directoryKey")
+	expect(t, ctx, h, ":2\r\n", "HSET", "directoryKey", "a", "1", "b", "2")
+	expect(t, ctx, h, ":0\r\n", "HSET", "directoryKey", "a", "3")
+	expect(t, ctx, h, ":1\r\n", "HDEL", "directoryKey", "a")
+	expect(t, ctx, h, ":1\r\n", "HSET", "directoryKey", "a", "4")
+	expect(t, ctx, h, ":1\r\n", "HDEL", "directoryKey", "b")
+	expect(t, ctx, h, ":1\r\n", "HINCRBY", "directoryKey", "b", "1")
+	expect(t, ctx, h, ":2\r\n", "HLEN", "directoryKey")
+	run(t, ctx, h, "DEL", "directoryKey")
+}
+
+// The marker of a spilled map expires with the map
+func TestHybridMarkerTTL(t *testing.T) {
+	ctx := testContext(t, "hybrid")
+	ctx.hybridSpillFields = 2
+	h := testHandlers("hybrid")
+	run(t, ctx, h, "DEL", "markerKey")
+	expect(t, ctx, h, ":3\r\n", "HSET", "markerKey", "a", "1", "b", "2", "c", "3")
+	expect(t, ctx, h, ":1\r\n", "EXPIRE", "markerKey", "100")
+	key, err := buildKey(ctx, []byte("markerKey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := ctx.client.GetHeader(ctx.readPolicy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec == nil || rec.Expiration > 100 {
+		t.Errorf("marker of a spilled map: got %v, expected a TTL of at most 100", rec)
+	}
+	expect(t, ctx, h, ":1\r\n", "HDEL", "markerKey", "a")
+	expect(t, ctx, h, ":2\r\n", "HLEN", "markerKey")
+	run(t, ctx, h, "DEL", "markerKey")
+}
+
+// Outside of a client connection (inside MULTI), blocking pops do not block
+func TestBlockingPopOnce(t *testing.T) {
+	ctx := testContext(t, "standard")
+	h := testHandlers("standard")
+	run(t, ctx, h, "DEL", "blockingKey")
+	expect(t, ctx, h, "*-1\r\n", "BLPOP", "blockingKey", "0")
+	expect(t, ctx, h, ":1\r\n", "RPUSH", "blockingKey", "a")
+	expect(t, ctx, h, "*2\r\n$11\r\nblockingKey\r\n$1\r\na\r\n", "BLPOP", "blockingKey", "0")
+}
+
+// TTLs above the max TTL of Aerospike are refused
+func TestExpireTooLarge(t *testing.T) {
+	ctx := testContext(t, "standard")
+	h := testHandlers("standard")
+	run(t, ctx, h, "SET", "expireKey", "a")
+	expect(t, ctx, h, "-ERR invalid expire time in 'expire' command\r\n", "EXPIRE", "expireKey", "4294967294")
+	expect(t, ctx, h, "-ERR invalid expire time in 'expire' command\r\n", "EXPIRE", "expireKey", "315360001")
+	expect(t, ctx, h, "-ERR invalid expire time in 'pexpire' command\r\n", "PEXPIRE", "expireKey", "315360000001")
+	expect(t, ctx, h, "-ERR invalid expire time in 'set' command\r\n", "SET", "expireKey", "b", "EX", "4294967295")
+	expect(t, ctx, h, ":1\r\n", "EXPIRE", "expireKey", "315360000")
+	expect(t, ctx, h, "$1\r\na\r\n", "GET", "expireKey")
+	run(t, ctx, h, "DEL", "expireKey")
+}
+
+// SET NX GET returns the existing value, an EXAT in the past deletes the key
+func TestSetOptions(t *testing.T) {
+	ctx := testContext(t, "standard")
+	h := testHandlers("standard")
+	run(t, ctx, h, "DEL", "setKey")
+	expect(t, ctx, h, "$-1\r\n", "SET", "setKey", "a", "NX", "GET")
+	expect(t, ctx, h, "$1\r\na\r\n", "SET", "setKey", "b", "NX", "GET")
+	expect(t, ctx, h, "$-1\r\n", "SET", "setKey", "c", "NX", "EXAT", "1")
+	expect(t, ctx, h, "$1\r\na\r\n", "SET", "setKey", "d", "EXAT", "1", "GET")
+	expect(t, ctx, h, "$-1\r\n", "GET", "setKey")
+	expect(t, ctx, h, "$-1\r\n", "SET", "setKey", "e", "XX", "EXAT", "1")
+	expect(t, ctx, h, "+OK\r\n", "SET", "setKey", "f", "EXAT", "1")
+	expect(t, ctx, h, "$-1\r\n", "GET", "setKey")
+}
+
+// Concurrent writes crossing the spill threshold keep all the fields
+func TestHybridConcurrentSpill(t *testing.T) {
+	ctx := testContext(t, "hybrid")
+	ctx.hybridSpillFields = 5
+	h := testHandlers("hybrid")
+	run(t, ctx, h, "DEL", "spillKey")
+	expect(t, ctx, h, ":4\r\n", "HSET", "spillKey", "a", "1", "b", "2", "c", "3", "d", "4")
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			field := []byte("f" + strconv.Itoa(i))
+			errs <- h["HSET"].f(bytes.NewBuffer(nil), ctx, [][]byte{[]byte("spillKey"), field, []byte("x")})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(t, ctx, h, ":24\r\n", "HLEN", "spillKey")
+	expect(t, ctx, h, "$1\r\n1\r\n", "HGET", "spillKey", "a")
+	run(t, ctx, h, "DEL", "spillKey")
+}
+
+// gc deletes old orphan field records, and keeps the recent ones, which may
+// be written by a migration before its main record
+func TestGCKeepsRecentOrphans(t *testing.T) {
+	ctx := testContext(t, "expanded")
+	orphan := func(field string, createdAt int64) *as.Key {
+		key, err := formatCompositeKey(ctx, "gcKey_orphan00", field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ctx.client.Put(ctx.writePolicy, key, as.BinMap{
+			MAIN_KEY_BIN_NAME:   "gcKey_orphan00",
+			SECOND_KEY_BIN_NAME: field,
+			VALUE_BIN_NAME:      "x",
+			"created_at":        createdAt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	recent := orphan("recent", now())
+	old := orphan("old", now()-int64(2*gcMinAge))
+	_, err := expandedMapGC(ctx, false, 0, gcMinAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := ctx.client.Exists(ctx.readPolicy, recent); err != nil || !exists {
+		t.Errorf("recent orphan: exists %v, %v", exists, err)
+	}
+	if exists, err := ctx.client.Exists(ctx.readPolicy, old); err != nil || exists {
+		t.Errorf("old orphan: exists %v, %v", exists, err)
+	}
+	ctx.client.Delete(ctx.writePolicy, recent)
+}
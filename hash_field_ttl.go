@@ -0,0 +1,584 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Expiration of hash fields (HEXPIRE, HTTL, HPERSIST).
+// Expanded map fields are records: HEXPIRE sets their TTL, and marks them
+// with the bin FIELD_TTL_BIN_NAME, which tells an expiration set by HEXPIRE
+// from the default TTL of the map. The standard and CDT layouts keep the
+// expiration times of the fields, in unix milliseconds, in the map bin
+// FIELD_EXPIRATIONS_BIN_NAME of the record. Reads skip the expired fields.
+// When hash_field_ttl is enabled on the set, writes remove the expired fields
+// they modify first, and HSET / HMSET / HDEL remove the expiration of the
+// fields they write.
+
+const FIELD_TTL_BIN_NAME = "e"
+const FIELD_EXPIRATIONS_BIN_NAME = "__expirations"
+
+const errFieldTTLDisabled = "ERR hash field expiration is not enabled on this set"
+
+// Max expiration, in seconds, which can be given as an Aerospike TTL
+const maxFieldTTL = maxTTL
+
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// parseFieldsArgs parses FIELDS numfields field [field ...], which ends the
+// arguments of the hash field expiration commands
+func parseFieldsArgs(args [][]byte) ([]string, string) {
+	if len(args) < 2 || strings.ToUpper(string(args[0])) != "FIELDS" {
+		return nil, "ERR Mandatory argument FIELDS is missing or not at the right position"
+	}
+	n, ok := parseInt(args[1])
+	if !ok || n <= 0 {
+		return nil, "ERR Parameter `numFields` should be greater than 0"
+	}
+	if n != int64(len(args)-2) {
+		return nil, "ERR The `numfields` parameter must match the number of arguments"
+	}
+	fields := make([]string, n)
+	for i, f := range args[2:] {
+		fields[i] = string(f)
+	}
+	return fields, ""
+}
+
+// parseHashExpireArgs parses key, time, an optional NX / XX / GT / LT
+// condition, and the fields. Returns the expiration time in unix
+// milliseconds, or an error reply.
+func parseHashExpireArgs(args [][]byte, option string, now int64) (int64, string, []string, string) {
+	v, ok := parseInt(args[1])
+	if !ok {
+		return 0, "", nil, errNotInteger
+	}
+	ms := v
+	if option == "PX" {
+		v = ceilDiv(v, 1000)
+	} else if v <= maxFieldTTL {
+		ms = v * 1000
+	}
+	if v < 0 || v > maxFieldTTL {
+		return 0, "", nil, "ERR invalid expire time, must be >= 0 and <= " + strconv.FormatInt(maxFieldTTL, 10)
+	}
+	at := now + ms
+	condition := ""
+	rest := args[2:]
+	if len(rest) > 0 {
+		switch c := strings.ToUpper(string(rest[0])); c {
+		case "NX", "XX", "GT", "LT":
+			condition = c
+			rest = rest[1:]
+		}
+	}
+	fields, reply := parseFieldsArgs(rest)
+	return at, condition, fields, reply
+}
+
+func writeIntArray(wf io.Writer, values []int64) error {
+	err := writeLine(wf, "*"+strconv.Itoa(len(values)))
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		err = writeLine(wf, ":"+strconv.FormatInt(v, 10))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pairFields returns the fields of a list of field / value pairs
+func pairFields(args [][]byte) []string {
+	fields := make([]string, 0, len(args)/2)
+	for i := 0; i+1 < len(args); i += 2 {
+		fields = append(fields, string(args[i]))
+	}
+	return fields
+}
+
+// fieldExpirations returns the expiration times of the fields of a standard
+// or CDT map record
+func fieldExpirations(rec *as.Record) map[string]int64 {
+	expirations := make(map[string]int64)
+	if rec == nil {
+		return expirations
+	}
+	m, _ := rec.Bins[FIELD_EXPIRATIONS_BIN_NAME].(map[interface{}]interface{})
+	for k, v := range m {
+		field, ok := k.(string)
+		at, ok2 := v.(int)
+		if ok && ok2 {
+			expirations[field] = int64(at)
+		}
+	}
+	return expirations
+}
+
+func fieldExpired(expirations map[string]int64, field string, now int64) bool {
+	at, ok := expirations[field]
+	return ok && at <= now
+}
+
+// removeExpiredFields removes the expired fields from values
+func removeExpiredFields(values map[string]interface{}, expirations map[string]int64) {
+	now := nowMillis()
+	for field := range expirations {
+		if fieldExpired(expirations, field, now) {
+			delete(values, field)
+		}
+	}
+}
+
+// hashValues returns the live fields of a standard map record
+func hashValues(rec *as.Record) map[string]interface{} {
+	if rec == nil {
+		return map[string]interface{}{}
+	}
+	expirations := fieldExpirations(rec)
+	delete(rec.Bins, FIELD_EXPIRATIONS_BIN_NAME)
+	removeExpiredFields(rec.Bins, expirations)
+	return rec.Bins
+}
+
+// hGetAllLive removes the expirations bin and the expired fields from the
+// field / value pairs returned by the HGETALL UDF
+func hGetAllLive(a []interface{}) []interface{} {
+	var expirations map[string]int64
+	for i := 0; i+1 < len(a); i += 2 {
+		if a[i] == FIELD_EXPIRATIONS_BIN_NAME {
+			expirations = fieldExpirations(&as.Record{Bins: as.BinMap{FIELD_EXPIRATIONS_BIN_NAME: a[i+1]}})
+		}
+	}
+	if expirations == nil {
+		return a
+	}
+	now := nowMillis()
+	out := make([]interface{}, 0, len(a))
+	for i := 0; i+1 < len(a); i += 2 {
+		field, _ := a[i].(string)
+		if field != FIELD_EXPIRATIONS_BIN_NAME && !fieldExpired(expirations, field, now) {
+			out = append(out, a[i], a[i+1])
+		}
+	}
+	return out
+}
+
+// hashGetFields reads some fields of a standard map, skipping the expired ones
+func hashGetFields(ctx *context, key *as.Key, fields ...string) (map[string]interface{}, error) {
+	bins := append(append(make([]string, 0, len(fields)+1), fields...), FIELD_EXPIRATIONS_BIN_NAME)
+	rec, err := ctx.client.Get(ctx.readPolicy, key, bins...)
+	if err != nil {
+		return nil, err
+	}
+	return hashValues(rec), nil
+}
+
+// readFieldExpirations reads which of the fields exist in a standard or CDT
+// map, whether they are expired or not, and the expiration times of the map
+func readFieldExpirations(ctx *context, key *as.Key, fields []string, cdt bool) (*as.Record, map[string]bool, map[string]int64, error) {
+	var rec *as.Record
+	var err error
+	if cdt {
+		rec, err = ctx.client.Get(ctx.readPolicy, key, cdtMapBinName, FIELD_EXPIRATIONS_BIN_NAME)
+	} else {
+		bins := append(append(make([]string, 0, len(fields)+1), fields...), FIELD_EXPIRATIONS_BIN_NAME)
+		rec, err = ctx.client.Get(ctx.readPolicy, key, bins...)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	exists := make(map[string]bool)
+	if rec == nil {
+		return nil, exists, map[string]int64{}, nil
+	}
+	m, _ := rec.Bins[cdtMapBinName].(map[interface{}]interface{})
+	for _, f := range fields {
+		if cdt {
+			exists[f] = m[f] != nil
+		} else {
+			exists[f] = rec.Bins[f] != nil
+		}
+	}
+	return rec, exists, fieldExpirations(rec), nil
+}
+
+// updateFieldExpirations applies f to each field of a standard or CDT map,
+// after removing the expired ones. f gets whether the field exists and its
+// expiration time, 0 if none, and returns the reply for the field, its new
+// expiration time, and whether the field must be removed. The changes are
+// written if the map has not been modified in the meantime.
+func updateFieldExpirations(ctx *context, key *as.Key, fields []string, cdt bool, now int64, f func(exists bool, at int64) (int64, int64, bool)) ([]int64, error) {
+	results := make([]int64, len(fields))
+	err := casRetry(func() error {
+		rec, exists, expirations, err := readFieldExpirations(ctx, key, fields, cdt)
+		if err != nil {
+			return err
+		}
+		updated := make(map[interface{}]interface{})
+		for field, at := range expirations {
+			updated[field] = at
+		}
+		removed := make([]string, 0)
+		remove := func(field string) {
+			if exists[field] {
+				removed = append(removed, field)
+				exists[field] = false
+			}
+			delete(updated, field)
+			delete(expirations, field)
+		}
+		changed := false
+		for i, field := range fields {
+			if fieldExpired(expirations, field, now) {
+				remove(field)
+				changed = true
+			}
+			at := expirations[field]
+			result, newAt, del := f(exists[field], at)
+			results[i] = result
+			if del {
+				remove(field)
+				changed = true
+			} else if newAt != at {
+				if newAt == 0 {
+					delete(updated, field)
+					delete(expirations, field)
+				} else {
+					updated[field] = newAt
+					expirations[field] = newAt
+				}
+				changed = true
+			}
+		}
+		if !changed || rec == nil {
+			return nil
+		}
+		ops := make([]*as.Operation, 0, len(removed)+2)
+		if cdt && len(removed) > 0 {
+			keys := make([]interface{}, len(removed))
+			for i, field := range removed {
+				keys[i] = field
+			}
+			ops = append(ops, as.MapRemoveByKeyListOp(cdtMapBinName, keys, as.MapReturnType.NONE))
+		} else {
+			for _, field := range removed {
+				ops = append(ops, as.PutOp(as.NewBin(field, nil)))
+			}
+		}
+		if len(updated) == 0 {
+			ops = append(ops, as.PutOp(as.NewBin(FIELD_EXPIRATIONS_BIN_NAME, nil)))
+		} else {
+			ops = append(ops, as.PutOp(as.NewBin(FIELD_EXPIRATIONS_BIN_NAME, updated)))
+		}
+		// removing the last bin of a standard record removes the record
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, ttlDontUpdate, rec), key, ops...)
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return nil
+		}
+		if err != nil || !cdt || len(removed) == 0 {
+			return err
+		}
+		return cdtMapDeleteIfEmpty(ctx, key)
+	})
+	return results, err
+}
+
+// purgeFields removes the expired fields among fields, before a write. If
+// clear is true, the expiration of the other fields is removed.
+func purgeFields(ctx *context, key *as.Key, cdt bool, clear bool, fields ...string) error {
+	if !ctx.hashFieldTTL || len(fields) == 0 {
+		return nil
+	}
+	_, err := updateFieldExpirations(ctx, key, fields, cdt, nowMillis(), func(exists bool, at int64) (int64, int64, bool) {
+		if clear {
+			return 0, 0, false
+		}
+		return 0, at, false
+	})
+	return err
+}
+
+func purgeHashFields(ctx *context, k []byte, cdt bool, clear bool, fields ...string) error {
+	if !ctx.hashFieldTTL {
+		return nil
+	}
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	return purgeFields(ctx, key, cdt, clear, fields...)
+}
+
+func hashExpire(wf io.Writer, ctx *context, args [][]byte, option string, cdt bool) error {
+	if !ctx.hashFieldTTL {
+		return writeErrorReply(wf, errFieldTTLDisabled)
+	}
+	now := nowMillis()
+	at, condition, fields, reply := parseHashExpireArgs(args, option, now)
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	results, err := updateFieldExpirations(ctx, key, fields, cdt, now, func(exists bool, current int64) (int64, int64, bool) {
+		if !exists {
+			return -2, current, false
+		}
+		remaining := int64(-1)
+		if current > 0 {
+			remaining = current - now
+		}
+		if condition != "" && !expireConditionMet(condition, remaining, int(at-now)) {
+			return 0, current, false
+		}
+		if at <= now {
+			return 2, 0, true
+		}
+		return 1, at, false
+	})
+	if err != nil {
+		return err
+	}
+	return writeIntArray(wf, results)
+}
+
+func hashTTL(wf io.Writer, ctx *context, args [][]byte, unit string, cdt bool) error {
+	fields, reply := parseFieldsArgs(args[1:])
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	now := nowMillis()
+	results, err := updateFieldExpirations(ctx, key, fields, cdt, now, func(exists bool, at int64) (int64, int64, bool) {
+		if !exists {
+			return -2, at, false
+		}
+		if at == 0 {
+			return -1, at, false
+		}
+		if unit == "PTTL" {
+			return at - now, at, false
+		}
+		return ceilDiv(at-now, 1000), at, false
+	})
+	if err != nil {
+		return err
+	}
+	return writeIntArray(wf, results)
+}
+
+func hashPersist(wf io.Writer, ctx *context, args [][]byte, cdt bool) error {
+	fields, reply := parseFieldsArgs(args[1:])
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	results, err := updateFieldExpirations(ctx, key, fields, cdt, nowMillis(), func(exists bool, at int64) (int64, int64, bool) {
+		if !exists {
+			return -2, at, false
+		}
+		if at == 0 {
+			return -1, at, false
+		}
+		return 1, 0, false
+	})
+	if err != nil {
+		return err
+	}
+	return writeIntArray(wf, results)
+}
+
+func cmdHEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashExpire(wf, ctx, args, "EX", false)
+}
+
+func cmdHPEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashExpire(wf, ctx, args, "PX", false)
+}
+
+func cmdHTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashTTL(wf, ctx, args, "TTL", false)
+}
+
+func cmdHPTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashTTL(wf, ctx, args, "PTTL", false)
+}
+
+func cmdHPERSIST(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashPersist(wf, ctx, args, false)
+}
+
+func cmdCdtMapHEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashExpire(wf, ctx, args, "EX", true)
+}
+
+func cmdCdtMapHPEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashExpire(wf, ctx, args, "PX", true)
+}
+
+func cmdCdtMapHTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashTTL(wf, ctx, args, "TTL", true)
+}
+
+func cmdCdtMapHPTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashTTL(wf, ctx, args, "PTTL", true)
+}
+
+func cmdCdtMapHPERSIST(wf io.Writer, ctx *context, args [][]byte) error {
+	return hashPersist(wf, ctx, args, true)
+}
+
+// expandedMapFieldKeys returns the keys of the field records of a map, nil if
+// the map does not exist
+func expandedMapFieldKeys(ctx *context, k []byte, fields []string) ([]*as.Key, error) {
+	suffixedKey, err := compositeExists(ctx, string(k))
+	if err != nil || suffixedKey == nil {
+		return nil, err
+	}
+	keys := make([]*as.Key, len(fields))
+	for i, f := range fields {
+		keys[i], err = formatCompositeKey(ctx, *suffixedKey, f)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// expandedMapFieldTTL reads a field record. Returns its TTL in seconds if it
+// has been set by HEXPIRE, -1 otherwise, and -2 if the field does not exist.
+func expandedMapFieldTTL(ctx *context, key *as.Key) (*as.Record, int64, error) {
+	rec, err := ctx.client.Get(ctx.readPolicy, key, FIELD_TTL_BIN_NAME)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rec == nil {
+		return nil, -2, nil
+	}
+	if rec.Bins[FIELD_TTL_BIN_NAME] == nil || rec.Expiration == ttlNeverExpire {
+		return rec, -1, nil
+	}
+	return rec, int64(rec.Expiration), nil
+}
+
+// expandedMapFieldsUpdate applies f to the field records of a map, with CAS.
+// f gets the field, its record and its TTL, and returns the reply for the
+// field.
+func expandedMapFieldsUpdate(wf io.Writer, ctx *context, k []byte, fields []string, f func(field string, key *as.Key, rec *as.Record, ttl int64) (int64, error)) error {
+	keys, err := expandedMapFieldKeys(ctx, k, fields)
+	if err != nil {
+		return err
+	}
+	results := make([]int64, len(fields))
+	for i := range fields {
+		if keys == nil {
+			results[i] = -2
+			continue
+		}
+		err = casRetry(func() error {
+			rec, ttl, err := expandedMapFieldTTL(ctx, keys[i])
+			if err != nil {
+				return err
+			}
+			if ttl == -2 {
+				results[i] = -2
+				return nil
+			}
+			results[i], err = f(fields[i], keys[i], rec, ttl)
+			if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+				results[i] = -2
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeIntArray(wf, results)
+}
+
+func expandedMapHExpire(wf io.Writer, ctx *context, args [][]byte, option string) error {
+	now := nowMillis()
+	at, condition, fields, reply := parseHashExpireArgs(args, option, now)
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	ttl := int(ceilDiv(at-now, 1000))
+	return expandedMapFieldsUpdate(wf, ctx, args[0], fields, func(field string, key *as.Key, rec *as.Record, current int64) (int64, error) {
+		if condition != "" && !expireConditionMet(condition, current, ttl) {
+			return 0, nil
+		}
+		if ttl <= 0 {
+			_, err := ctx.client.Delete(fillWritePolicyCas(ctx, -1, rec), key)
+			if err != nil {
+				return 0, err
+			}
+			return 2, expandedMapRemoveFields(ctx, string(args[0]), field)
+		}
+		_, err := ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, as.PutOp(as.NewBin(FIELD_TTL_BIN_NAME, 1)))
+		return 1, err
+	})
+}
+
+func cmdExpandedMapHEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapHExpire(wf, ctx, args, "EX")
+}
+
+func cmdExpandedMapHPEXPIRE(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapHExpire(wf, ctx, args, "PX")
+}
+
+func expandedMapHTTL(wf io.Writer, ctx *context, args [][]byte, unit string) error {
+	fields, reply := parseFieldsArgs(args[1:])
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return expandedMapFieldsUpdate(wf, ctx, args[0], fields, func(field string, key *as.Key, rec *as.Record, ttl int64) (int64, error) {
+		if ttl >= 0 && unit == "PTTL" {
+			return ttl * 1000, nil
+		}
+		return ttl, nil
+	})
+}
+
+func cmdExpandedMapHTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapHTTL(wf, ctx, args, "TTL")
+}
+
+func cmdExpandedMapHPTTL(wf io.Writer, ctx *context, args [][]byte) error {
+	return expandedMapHTTL(wf, ctx, args, "PTTL")
+}
+
+func cmdExpandedMapHPERSIST(wf io.Writer, ctx *context, args [][]byte) error {
+	fields, reply := parseFieldsArgs(args[1:])
+	if reply != "" {
+		return writeErrorReply(wf, reply)
+	}
+	return expandedMapFieldsUpdate(wf, ctx, args[0], fields, func(field string, key *as.Key, rec *as.Record, ttl int64) (int64, error) {
+		if ttl == -1 {
+			return -1, nil
+		}
+		// back to the TTL of the other fields
+		_, err := ctx.client.Operate(fillWritePolicyCas(ctx, ctx.expandedMapDefaultTTL, rec), key, as.PutOp(as.NewBin(FIELD_TTL_BIN_NAME, nil)))
+		return 1, err
+	})
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Commands of the standard map implementation: each field is a bin of the
+// record. The functions writing the replies are shared with the expanded map
+// implementation.
+
+// hashGetAll reads all the fields of a map, sorted by name
+func hashGetAll(ctx *context, key *as.Key) ([]string, map[string]interface{}, error) {
+	rec, err := ctx.client.Get(ctx.readPolicy, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := hashValues(rec)
+	return sortedFields(values), values, nil
+}
+
+func sortedFields(values map[string]interface{}) []string {
+	fields := make([]string, 0, len(values))
+	for f := range values {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// hashSet stores the field / value pairs of args, and returns the number of
+// fields which have been created. The fields are read and written in the
+// same operation.
+func hashSet(ctx *context, key *as.Key, args [][]byte) (int, error) {
+	fields := make([]string, 0, len(args)/2)
+	bins := as.BinMap{}
+	for i := 0; i+1 < len(args); i += 2 {
+		field := string(args[i])
+		if _, ok := bins[field]; !ok {
+			fields = append(fields, field)
+		}
+		bins[field] = encode(ctx, args[i+1])
+	}
+	ops := make([]*as.Operation, 0, 2*len(fields))
+	for _, f := range fields {
+		ops = append(ops, as.GetOpForBin(f))
+	}
+	for _, f := range fields {
+		ops = append(ops, as.PutOp(as.NewBin(f, bins[f])))
+	}
+	rec, err := ctx.client.Operate(fillWritePolicyEx(ctx, -1, false), key, ops...)
+	if err != nil {
+		return 0, err
+	}
+	created := len(fields)
+	for _, f := range fields {
+		if rec.Bins[f] != nil {
+			created--
+		}
+	}
+	return created, nil
+}
+
+// hashDel removes the fields, and returns the number of removed fields. The
+// fields are read and removed in the same operation. Removing the last bin
+// of a record removes the record.
+func hashDel(ctx *context, key *as.Key, fields []string) (int, error) {
+	unique := make([]string, 0, len(fields))
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		// a field given twice is removed once
+		if !seen[f] {
+			seen[f] = true
+			unique = append(unique, f)
+		}
+	}
+	ops := make([]*as.Operation, 0, 2*len(unique))
+	for _, f := range unique {
+		ops = append(ops, as.GetOpForBin(f))
+	}
+	for _, f := range unique {
+		ops = append(ops, as.PutOp(as.NewBin(f, nil)))
+	}
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, -1, as.UPDATE_ONLY), key, ops...)
+	if err != nil {
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return 0, nil
+		}
+		return 0, err
+	}
+	removed := 0
+	for _, f := range unique {
+		if rec.Bins[f] != nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func writeHashKeys(wf io.Writer, fields []string) error {
+	err := writeLine(wf, "*"+strconv.Itoa(len(fields)))
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		err = writeByteArray(wf, []byte(f))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHashValues(wf io.Writer, fields []string, values map[string]interface{}) error {
+	err := writeLine(wf, "*"+strconv.Itoa(len(fields)))
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		err = writeValue(wf, values[f])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHashAll writes the field / value pairs of a map
+func writeHashAll(wf io.Writer, fields []string, values map[string]interface{}) error {
+	err := writeLine(wf, "*"+strconv.Itoa(2*len(fields)))
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		err = writeByteArray(wf, []byte(f))
+		if err != nil {
+			return err
+		}
+		err = writeValue(wf, values[f])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeStrLen(wf io.Writer, x interface{}) error {
+	if x == nil {
+		return writeLine(wf, ":0")
+	}
+	buf, err := decodeValue(x)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(len(buf)))
+}
+
+// writeRandomFields implements HRANDFIELD: args are the optional count and
+// WITHVALUES option. A positive count returns distinct fields, a negative
+// count allows the same field to be returned several times.
+func writeRandomFields(wf io.Writer, fields []string, values map[string]interface{}, args [][]byte) error {
+	if len(args) == 0 {
+		if len(fields) == 0 {
+			return writeLine(wf, "$-1")
+		}
+		return writeByteArray(wf, []byte(fields[rand.Intn(len(fields))]))
+	}
+	count, ok := parseInt(args[0])
+	if !ok {
+		return writeErrorReply(wf, errNotInteger)
+	}
+	withValues := false
+	if len(args) == 2 && strings.ToUpper(string(args[1])) == "WITHVALUES" {
+		withValues = true
+	} else if len(args) > 1 {
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	// like Redis, the number of returned elements must fit in an int64
+	if count == math.MinInt64 || withValues && count < -math.MaxInt64/2 {
+		return writeErrorReply(wf, "ERR value is out of range")
+	}
+	var selected []string
+	n := int64(0)
+	if count >= 0 {
+		selected = make([]string, len(fields))
+		for i, j := range rand.Perm(len(fields)) {
+			selected[i] = fields[j]
+		}
+		if count < int64(len(selected)) {
+			selected = selected[:count]
+		}
+		n = int64(len(selected))
+	} else if len(fields) > 0 {
+		// fields are drawn while writing, the reply can be larger than memory
+		n = -count
+	}
+	l := n
+	if withValues {
+		l *= 2
+	}
+	err := writeLine(wf, "*"+strconv.FormatInt(l, 10))
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < n; i++ {
+		var f string
+		if selected != nil {
+			f = selected[i]
+		} else {
+			f = fields[rand.Intn(len(fields))]
+		}
+		err = writeByteArray(wf, []byte(f))
+		if err != nil {
+			return err
+		}
+		if withValues {
+			err = writeValue(wf, values[f])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cmdHEXISTS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	values, err := hashGetFields(ctx, key, string(args[1]))
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, values[string(args[1])] != nil)
+}
+
+func cmdHLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fields, _, err := hashGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(len(fields)))
+}
+
+func cmdHKEYS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fields, _, err := hashGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeHashKeys(wf, fields)
+}
+
+func cmdHVALS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fields, values, err := hashGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeHashValues(wf, fields, values)
+}
+
+func cmdHSETNX(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	field := string(args[1])
+	err = purgeFields(ctx, key, false, false, field)
+	if err != nil {
+		return err
+	}
+	created := false
+	err = casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key, field)
+		if err != nil {
+			return err
+		}
+		created = rec == nil || rec.Bins[field] == nil
+		if !created {
+			return nil
+		}
+		return ctx.client.Put(fillWritePolicyCas(ctx, -1, rec), key, as.BinMap{field: encode(ctx, args[2])})
+	})
+	if err != nil {
+		return err
+	}
+	return writeBool(wf, created)
+}
+
+func cmdHSTRLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	values, err := hashGetFields(ctx, key, string(args[1]))
+	if err != nil {
+		return err
+	}
+	return writeStrLen(wf, values[string(args[1])])
+}
+
+func cmdHRANDFIELD(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	fields, values, err := hashGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeRandomFields(wf, fields, values, args[1:])
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hot key and big key detection: with "hot_keys" in the configuration of a
+// set, one command out of hot_keys_sample is counted in a count-min sketch,
+// and a heap keeps the hot_keys most frequent keys. Counts are halved every
+// hot_keys_decay seconds, so old traffic fades out. Replies larger than
+// big_key_bytes bytes or big_key_elements array elements flag their key as
+// big. HOTKEYS returns the hot keys, HOTKEYS BIG the biggest keys.
+
+const errHotKeysDisabled = "ERR hot keys tracking is not enabled on this set"
+
+// Commands whose first argument is not a key
+var hotKeysExcludedCommands = map[string]bool{"SCAN": true, "KEYS": true}
+
+const sketchDepth = 4
+const sketchWidth = 2048
+
+type hotKey struct {
+	key   string
+	count uint32
+	index int
+}
+
+// hotKeyHeap is a min heap on count
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	e := x.(*hotKey)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// byCount sorts keys, highest count first
+type byCount []hotKey
+
+func (a byCount) Len() int           { return len(a) }
+func (a byCount) Less(i, j int) bool { return a[i].count > a[j].count }
+func (a byCount) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+type hotKeys struct {
+	set    string
+	mu     sync.Mutex
+	sketch [sketchDepth][sketchWidth]uint32
+	top    hotKeyHeap
+	byKey  map[string]*hotKey
+	size   int
+	sample uint32
+	seen   uint32
+	// biggest replies by key
+	big             map[string]int
+	bigKeyBytes     int
+	bigKeyElements  int
+	bigKeysDetected uint32
+}
+
+func newHotKeys(set string, size int, sample int, bigKeyBytes int, bigKeyElements int) *hotKeys {
+	return &hotKeys{
+		set:            set,
+		byKey:          make(map[string]*hotKey),
+		size:           size,
+		sample:         uint32(sample),
+		big:            make(map[string]int),
+		bigKeyBytes:    bigKeyBytes,
+		bigKeyElements: bigKeyElements,
+	}
+}
+
+// add counts the key k in the sketch, and returns its estimated count
+func (t *hotKeys) add(k string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(k))
+	sum := h.Sum64()
+	h1 := uint32(sum)
+	h2 := uint32(sum >> 32)
+	var min uint32
+	for i := 0; i < sketchDepth; i++ {
+		j := (h1 + uint32(i)*h2) % sketchWidth
+		t.sketch[i][j]++
+		if i == 0 || t.sketch[i][j] < min {
+			min = t.sketch[i][j]
+		}
+	}
+	return min
+}
+
+// record samples a command on the key k
+func (t *hotKeys) record(k []byte) {
+	if t.sample > 1 && atomic.AddUint32(&t.seen, 1)%t.sample != 0 {
+		return
+	}
+	key := string(k)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	count := t.add(key)
+	if e, ok := t.byKey[key]; ok {
+		e.count = count
+		heap.Fix(&t.top, e.index)
+		return
+	}
+	if len(t.top) < t.size {
+		e := &hotKey{key: key, count: count}
+		heap.Push(&t.top, e)
+		t.byKey[key] = e
+		return
+	}
+	if len(t.top) > 0 && count > t.top[0].count {
+		e := t.top[0]
+		delete(t.byKey, e.key)
+		e.key = key
+		e.count = count
+		t.byKey[key] = e
+		heap.Fix(&t.top, 0)
+	}
+}
+
+// decay halves all the counts
+func (t *hotKeys) decay() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] >>= 1
+		}
+	}
+	for _, e := range t.top {
+		e.count >>= 1
+	}
+}
+
+func (t *hotKeys) decayLoop(period time.Duration) {
+	ticker := time.NewTicker(period)
+	for range ticker.C {
+		t.decay()
+	}
+}
+
+// hot returns the hot keys, most frequent first, with their estimated
+// number of commands
+func (t *hotKeys) hot() []hotKey {
+	t.mu.Lock()
+	keys := make([]hotKey, 0, len(t.top))
+	for _, e := range t.top {
+		if e.count > 0 {
+			keys = append(keys, hotKey{key: e.key, count: e.count * t.sample})
+		}
+	}
+	t.mu.Unlock()
+	sort.Sort(byCount(keys))
+	return keys
+}
+
+// recordReply flags the key k as big if the reply is too large. Only the
+// size biggest keys are kept.
+func (t *hotKeys) recordReply(cmd string, k []byte, reply *replyRecorder) {
+	size := reply.size
+	elements := reply.elements()
+	if (t.bigKeyBytes <= 0 || size < t.bigKeyBytes) && (t.bigKeyElements <= 0 || elements < t.bigKeyElements) {
+		return
+	}
+	key := string(k)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if previous, ok := t.big[key]; ok {
+		if size > previous {
+			t.big[key] = size
+		}
+		return
+	}
+	if len(t.big) >= t.size {
+		smallest := ""
+		for b, s := range t.big {
+			if smallest == "" || s < t.big[smallest] {
+				smallest = b
+			}
+		}
+		if t.big[smallest] >= size {
+			return
+		}
+		delete(t.big, smallest)
+	}
+	t.big[key] = size
+	atomic.AddUint32(&t.bigKeysDetected, 1)
+	log.Printf("%s: Big key %s: %s replied %d bytes, %d elements", t.set, key, cmd, size, elements)
+}
+
+// sendStats sends the counts of the hot keys by rank, 0 for the ranks
+// without key, and the number of big keys detected since the last call.
+// Key names are only returned by HOTKEYS: they would leak to statsd, with
+// one metric per key ever seen.
+func (t *hotKeys) sendStats(conn *net.UDPConn, prefix string) {
+	keys := t.hot()
+	for i := 0; i < t.size; i++ {
+		count := uint32(0)
+		if i < len(keys) {
+			count = keys[i].count
+		}
+		udpSend(conn, prefix+"hot_keys."+strconv.Itoa(i+1)+":"+strconv.Itoa(int(count))+"|g")
+	}
+	detected := atomic.SwapUint32(&t.bigKeysDetected, 0)
+	udpSend(conn, prefix+"big_keys:"+strconv.Itoa(int(detected))+"|c")
+}
+
+// replyRecorder measures a reply, and keeps its first line
+type replyRecorder struct {
+	w      io.Writer
+	size   int
+	header []byte
+}
+
+func (r *replyRecorder) Write(p []byte) (int, error) {
+	if len(r.header) < 32 {
+		n := 32 - len(r.header)
+		if n > len(p) {
+			n = len(p)
+		}
+		r.header = append(r.header, p[:n]...)
+	}
+	r.size += len(p)
+	return r.w.Write(p)
+}
+
+func (r *replyRecorder) watch() (<-chan struct{}, func(), bool) {
+	if watcher, ok := r.w.(clientWatcher); ok {
+		return watcher.watch()
+	}
+	return nil, nil, false
+}
+
+// elements returns the number of elements of an array reply, 0 for other
+// replies
+func (r *replyRecorder) elements() int {
+	if len(r.header) == 0 || r.header[0] != '*' {
+		return 0
+	}
+	i := bytes.IndexByte(r.header, '\r')
+	if i == -1 {
+		return 0
+	}
+	n, err := strconv.Atoi(string(r.header[1:i]))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func cmdHOTKEYS(wf io.Writer, ctx *context, args [][]byte) error {
+	if ctx.hotKeys == nil {
+		return writeErrorReply(wf, errHotKeysDisabled)
+	}
+	t := ctx.hotKeys
+	reply := make([]interface{}, 0)
+	if len(args) > 0 && bytes.EqualFold(args[0], []byte("BIG")) {
+		t.mu.Lock()
+		big := make([]hotKey, 0, len(t.big))
+		for k, s := range t.big {
+			big = append(big, hotKey{key: k, count: uint32(s)})
+		}
+		t.mu.Unlock()
+		sort.Sort(byCount(big))
+		for _, e := range big {
+			reply = append(reply, e.key, int(e.count))
+		}
+		return writeArray(wf, reply)
+	}
+	for _, e := range t.hot() {
+		reply = append(reply, e.key, int(e.count))
+	}
+	return writeArray(wf, reply)
+}
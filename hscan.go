@@ -0,0 +1,207 @@
+package main
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// HSCAN. Fields are walked in the order of a 64 bits hash of their name,
+// and the cursor is the hash to start from, so fields written or deleted
+// between two calls do not move the others. Sets and sorted sets are not
+// implemented, so there is no SSCAN or ZSCAN.
+
+// fieldPosition returns the position of a field in the HSCAN order
+func fieldPosition(field string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(field))
+	return h.Sum64()
+}
+
+// hscanPage selects the count first fields from the cursor position, only
+// keeping count fields in memory
+type hscanPage struct {
+	start uint64
+	count int
+	match []byte
+	h     scanHeap
+	found int
+}
+
+// parseHScanArgs parses the arguments following the key. Returns false if
+// they are invalid, after having written the error.
+func parseHScanArgs(wf io.Writer, args [][]byte) (*hscanPage, bool, error) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return nil, false, writeErrorReply(wf, errInvalidCursor)
+	}
+	p := &hscanPage{start: cursor, count: 10}
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, false, writeErrorReply(wf, "ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			p.match = args[i+1]
+		case "COUNT":
+			c, ok := parseInt(args[i+1])
+			if !ok || c < 1 {
+				return nil, false, writeErrorReply(wf, "ERR syntax error")
+			}
+			p.count = int(c)
+		default:
+			return nil, false, writeErrorReply(wf, "ERR syntax error")
+		}
+	}
+	return p, true, nil
+}
+
+func (p *hscanPage) add(field string) {
+	position := fieldPosition(field)
+	if position < p.start {
+		return
+	}
+	if p.match != nil && !stringMatch(p.match, []byte(field)) {
+		return
+	}
+	p.found++
+	heap.Push(&p.h, scanEntry{position, field})
+	if p.h.Len() > p.count {
+		heap.Pop(&p.h)
+	}
+}
+
+// fields returns the selected fields, and the next cursor
+func (p *hscanPage) fields() ([]string, uint64) {
+	fields := make([]string, p.h.Len())
+	var last uint64
+	for i := len(fields) - 1; i >= 0; i-- {
+		e := heap.Pop(&p.h).(scanEntry)
+		if i == len(fields)-1 {
+			last = e.position
+		}
+		fields[i] = e.key
+	}
+	if p.found <= p.count || last == math.MaxUint64 {
+		return fields, 0
+	}
+	return fields, last + 1
+}
+
+// writeHScan writes the next cursor and the field / value pairs
+func writeHScan(wf io.Writer, next uint64, fields []string, values map[string]interface{}) error {
+	err := writeLine(wf, "*2")
+	if err != nil {
+		return err
+	}
+	err = writeByteArray(wf, []byte(strconv.FormatUint(next, 10)))
+	if err != nil {
+		return err
+	}
+	return writeHashAll(wf, fields, values)
+}
+
+// hscanValues selects the fields of a map read at once
+func hscanValues(wf io.Writer, p *hscanPage, values map[string]interface{}) error {
+	for f := range values {
+		p.add(f)
+	}
+	fields, next := p.fields()
+	return writeHScan(wf, next, fields, values)
+}
+
+func cmdHSCAN(wf io.Writer, ctx *context, args [][]byte) error {
+	p, ok, err := parseHScanArgs(wf, args[1:])
+	if !ok {
+		return err
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, values, err := hashGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return hscanValues(wf, p, values)
+}
+
+func cmdCdtMapHSCAN(wf io.Writer, ctx *context, args [][]byte) error {
+	p, ok, err := parseHScanArgs(wf, args[1:])
+	if !ok {
+		return err
+	}
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, _, values, err := cdtMapGetAll(ctx, key)
+	if err != nil {
+		return err
+	}
+	return hscanValues(wf, p, values)
+}
+
+// cmdExpandedMapHSCAN selects the fields in the directory, or through the
+// secondary index for maps without directory, then only reads the values of
+// the selected fields. The index query cannot be paged: it reads all the
+// fields on each call, and is refused past expandedMapHScanLimit fields.
+func cmdExpandedMapHSCAN(wf io.Writer, ctx *context, args [][]byte) error {
+	p, ok, err := parseHScanArgs(wf, args[1:])
+	if !ok {
+		return err
+	}
+	suffixedKey, directoryFields, directory, err := expandedMapDirectory(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	values := make(map[string]interface{})
+	if suffixedKey == nil {
+		return writeHScan(wf, 0, []string{}, values)
+	}
+	if directory {
+		for _, f := range directoryFields {
+			p.add(f)
+		}
+	} else {
+		statment := as.NewStatement(ctx.ns, ctx.set, SECOND_KEY_BIN_NAME)
+		statment.Addfilter(as.NewEqualFilter(MAIN_KEY_BIN_NAME, *suffixedKey))
+		recordset, err := ctx.client.Query(nil, statment)
+		if err != nil {
+			return err
+		}
+		defer recordset.Close()
+		read := 0
+		for res := range recordset.Results() {
+			if res.Err != nil {
+				return res.Err
+			}
+			read++
+			if ctx.expandedMapHScanLimit > 0 && read > ctx.expandedMapHScanLimit {
+				return writeErrorReply(wf, "ERR HSCAN is refused on a map without directory of more than "+strconv.Itoa(ctx.expandedMapHScanLimit)+" fields")
+			}
+			if field, ok := res.Record.Bins[SECOND_KEY_BIN_NAME].(string); ok {
+				p.add(field)
+			}
+		}
+	}
+	fields, next := p.fields()
+	out, err := expandedMapBatchGet(ctx, *suffixedKey, fields)
+	if err != nil {
+		return err
+	}
+	live := make([]string, 0, len(fields))
+	for i, rec := range out {
+		// the field may have been deleted, or have expired
+		if rec != nil && rec.Bins[VALUE_BIN_NAME] != nil {
+			values[fields[i]] = rec.Bins[VALUE_BIN_NAME]
+			live = append(live, fields[i])
+		}
+	}
+	return writeHScan(wf, next, live, values)
+}
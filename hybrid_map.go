@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Hybrid map implementation: a map starts in the standard layout, and spills
+// to the expanded layout once it has more than hybridSpillFields fields, more
+// than hybridSpillSize bytes, or a field name which cannot be a bin name.
+// Spilling copies the fields to an expanded map, and replaces them in the
+// standard record by the marker bin SPILLED_BIN_NAME, which tells the
+// handlers to use the expanded layout for this key. The marker record has the
+// TTL of the expanded main record, updated by the commands changing it, so
+// it expires with the map. A spilled map stays in the expanded layout until
+// it is deleted or expires.
+
+const SPILLED_BIN_NAME = "__expanded"
+
+// Max length of an Aerospike bin name
+const maxBinNameLength = 14
+
+// hybridGrowingCommands returns the fields a command can create
+var hybridGrowingCommands = map[string]func(args [][]byte) []string{
+	"HSET":         func(args [][]byte) []string { return pairFields(args[1:]) },
+	"HMSET":        func(args [][]byte) []string { return pairFields(args[1:]) },
+	"HSETNX":       func(args [][]byte) []string { return []string{string(args[1])} },
+	"HINCRBY":      func(args [][]byte) []string { return []string{string(args[1])} },
+	"HINCRBYEX":    func(args [][]byte) []string { return []string{string(args[1])} },
+	"HINCRBYFLOAT": func(args [][]byte) []string { return []string{string(args[1])} },
+	"HMINCRBYEX":   func(args [][]byte) []string { return pairFields(args[2:]) },
+}
+
+// Commands applied to the layout of the key, in addition to the hash commands
+var hybridKeyCommands = []string{"EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "PERSIST"}
+
+// Commands which can change the TTL of the map
+var hybridTTLCommands = map[string]bool{"EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true, "PERSIST": true, "HINCRBYEX": true, "HMINCRBYEX": true}
+
+// Commands which modify the map without creating fields
+var hybridWriteCommands = map[string]bool{"HDEL": true, "HEXPIRE": true, "HPEXPIRE": true, "HPERSIST": true, "EXPIRE": true, "PEXPIRE": true, "EXPIREAT": true, "PEXPIREAT": true, "PERSIST": true}
+
+// hybridSpilled returns true if the map k uses the expanded layout
+func hybridSpilled(ctx *context, k []byte) (bool, error) {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return false, err
+	}
+	rec, err := ctx.client.Get(ctx.readPolicy, key, SPILLED_BIN_NAME)
+	if err != nil {
+		return false, err
+	}
+	return rec != nil && rec.Bins[SPILLED_BIN_NAME] != nil, nil
+}
+
+// hybridTooLarge returns true if the standard map must be spilled
+func hybridTooLarge(ctx *context, values map[string]interface{}) bool {
+	if ctx.hybridSpillFields > 0 && len(values) > ctx.hybridSpillFields {
+		return true
+	}
+	size := 0
+	for f, x := range values {
+		buf, _ := decodeValue(x)
+		size += len(f) + len(buf)
+	}
+	return ctx.hybridSpillSize > 0 && size > ctx.hybridSpillSize
+}
+
+// Age after which an expanded map without marker is left by an interrupted
+// spill
+const hybridStaleCopyAge = 60 * time.Second
+
+// mergeToExpanded moves to the expanded map k the fields written to the
+// standard record rec after it has been spilled
+func mergeToExpanded(ctx *context, k []byte, rec *as.Record) error {
+	values, fields := standardMapFields(rec)
+	suffixedKey, _, err := compositeExistsOrCreate(ctx, string(k), -1)
+	if err != nil {
+		return err
+	}
+	err = expandedMapAddFields(ctx, string(k), fields...)
+	if err != nil {
+		return err
+	}
+	return writeExpandedFields(ctx, *suffixedKey, rec, values, fields)
+}
+
+// hybridRemoveStaleCopy removes the expanded map k, found while spilling the
+// map, if it has been left by an interrupted spill. Returns an error making
+// casRetry spill again.
+func hybridRemoveStaleCopy(ctx *context, k []byte) error {
+	key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+	if err != nil {
+		return err
+	}
+	rec, err := ctx.client.Get(ctx.readPolicy, key, "created_at")
+	if err != nil {
+		return err
+	}
+	if rec != nil {
+		createdAt, _ := rec.Bins["created_at"].(int)
+		// created_at holds now(), in nanoseconds
+		if now()-int64(createdAt) > int64(hybridStaleCopyAge) {
+			_, err = expandedMapDelete(ctx, k, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// a concurrent spill is setting the marker, or the copy has been removed
+	return ase.NewAerospikeError(ase.GENERATION_ERROR)
+}
+
+// spillMap copies the fields of the standard map k to the expanded layout,
+// and replaces them by the marker bin. Fields written to the standard record
+// by a concurrent command are moved the same way. The marker is only set if
+// the standard record has not been modified during the copy, otherwise the
+// copy is removed and done again.
+func spillMap(ctx *context, k []byte) error {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	return casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key)
+		if err != nil {
+			return err
+		}
+		ops := []*as.Operation{as.PutOp(as.NewBin(SPILLED_BIN_NAME, 1))}
+		// the marker gets the TTL of the standard record, given to the
+		// expanded main record by the copy
+		ttl := ttlNeverExpire
+		if rec != nil && rec.Expiration != ttlNeverExpire {
+			ttl = int(rec.Expiration)
+		}
+		copied := false
+		if rec != nil {
+			for bin := range rec.Bins {
+				if bin != SPILLED_BIN_NAME {
+					ops = append(ops, as.PutOp(as.NewBin(bin, nil)))
+				}
+			}
+			if rec.Bins[SPILLED_BIN_NAME] != nil {
+				if len(ops) == 1 {
+					return nil
+				}
+				ttl = ttlDontUpdate
+				err = mergeToExpanded(ctx, k, rec)
+			} else {
+				copied, err = copyToExpanded(ctx, k, rec)
+				if err == nil && !copied {
+					return hybridRemoveStaleCopy(ctx, k)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, ops...)
+		if copied && errResultCode(err) == ase.GENERATION_ERROR {
+			_, delErr := expandedMapDelete(ctx, k, false)
+			if delErr != nil {
+				return delErr
+			}
+		}
+		return err
+	})
+}
+
+// hybridSyncMarker gives the marker of the spilled map k the TTL of its
+// expanded main record, or removes it if the expanded map does not exist
+// anymore
+func hybridSyncMarker(ctx *context, k []byte) error {
+	mainKey, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+	if err != nil {
+		return err
+	}
+	header, err := ctx.client.GetHeader(ctx.readPolicy, mainKey)
+	if err != nil {
+		return err
+	}
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	return casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key)
+		if err != nil {
+			return err
+		}
+		if rec == nil || rec.Bins[SPILLED_BIN_NAME] == nil {
+			return nil
+		}
+		if header == nil {
+			if len(rec.Bins) > 1 {
+				// fields written to the standard record, moved by the next
+				// spill
+				return nil
+			}
+			_, err = ctx.client.Delete(fillWritePolicyCas(ctx, -1, rec), key)
+			return err
+		}
+		ttl := ttlNeverExpire
+		if header.Expiration != ttlNeverExpire {
+			ttl = int(header.Expiration)
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, ttl, rec), key, as.TouchOp())
+		return err
+	})
+}
+
+// hybridCheckSize spills the standard map k if it is too large, or if it
+// holds fields written after it has been spilled
+func hybridCheckSize(ctx *context, k []byte) error {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	rec, err := ctx.client.Get(ctx.readPolicy, key)
+	if err != nil || rec == nil {
+		return err
+	}
+	if rec.Bins[SPILLED_BIN_NAME] != nil {
+		if len(rec.Bins) > 1 {
+			return spillMap(ctx, k)
+		}
+		return nil
+	}
+	if hybridTooLarge(ctx, hashValues(rec)) {
+		return spillMap(ctx, k)
+	}
+	return nil
+}
+
+func hybridDel(wf io.Writer, ctx *context, args [][]byte, async bool) error {
+	spilled, err := hybridSpilled(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if spilled {
+		_, err = expandedMapDelete(ctx, args[0], async)
+		if err != nil {
+			return err
+		}
+	}
+	// removes the standard map, or the marker
+	return cmdDEL(wf, ctx, args)
+}
+
+func cmdHybridMapDEL(wf io.Writer, ctx *context, args [][]byte) error {
+	return hybridDel(wf, ctx, args, false)
+}
+
+func cmdHybridMapUNLINK(wf io.Writer, ctx *context, args [][]byte) error {
+	return hybridDel(wf, ctx, args, true)
+}
+
+// hybridDispatch returns a handler applying the standard or the expanded
+// handler of a read command, depending on the layout of the key
+func hybridDispatch(standard handler, expanded handler) handler {
+	return handler{standard.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		spilled, err := hybridSpilled(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if spilled {
+			return expanded.f(wf, ctx, args)
+		}
+		return standard.f(wf, ctx, args)
+	}}
+}
+
+// hybridExpanded applies the expanded handler of a command, then updates the
+// TTL of the marker if needed
+func hybridExpanded(wf io.Writer, ctx *context, args [][]byte, name string, expanded handler, syncMarker bool) error {
+	err := expanded.f(wf, ctx, args)
+	if err != nil || !syncMarker && !hybridTTLCommands[name] {
+		return err
+	}
+	return hybridSyncMarker(ctx, args[0])
+}
+
+// hybridWrite returns a handler for a command which modifies the map without
+// creating fields. The map may be spilled while the standard handler runs,
+// which then misses the moved fields: the marker is read again after the
+// write, and the command is applied to the expanded map if it is set.
+func hybridWrite(name string, standard handler, expanded handler) handler {
+	return handler{standard.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		spilled, err := hybridSpilled(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if !spilled {
+			buf := bytes.NewBuffer(nil)
+			err = standard.f(buf, ctx, args)
+			if err != nil {
+				return err
+			}
+			spilled, err = hybridSpilled(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			if !spilled {
+				return write(wf, buf.Bytes())
+			}
+		}
+		return hybridExpanded(wf, ctx, args, name, expanded, false)
+	}}
+}
+
+// hybridGrowing returns a handler for a command which can create fields: the
+// map is spilled before the command if a field name is too long for a bin,
+// and after it if the map has become too large
+func hybridGrowing(name string, standard handler, expanded handler, newFields func(args [][]byte) []string) handler {
+	return handler{standard.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		spilled, err := hybridSpilled(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if spilled {
+			return hybridExpanded(wf, ctx, args, name, expanded, false)
+		}
+		for _, f := range newFields(args) {
+			if len(f) > maxBinNameLength {
+				spilled = true
+			}
+		}
+		if spilled {
+			err = spillMap(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			// the expanded main record may be created by the command
+			return hybridExpanded(wf, ctx, args, name, expanded, true)
+		}
+		err = standard.f(wf, ctx, args)
+		if err != nil {
+			return err
+		}
+		return hybridCheckSize(ctx, args[0])
+	}}
+}
+
+func hybridMapHandlers() map[string]handler {
+	handlers := standardHandlers()
+	expanded := expandedMapHandlers()
+	names := append(append(append([]string{}, migrationReadCommands...), migrationWriteCommands...), hybridKeyCommands...)
+	for _, name := range names {
+		if newFields, ok := hybridGrowingCommands[name]; ok {
+			handlers[name] = hybridGrowing(name, handlers[name], expanded[name], newFields)
+		} else if hybridWriteCommands[name] {
+			handlers[name] = hybridWrite(name, handlers[name], expanded[name])
+		} else {
+			handlers[name] = hybridDispatch(handlers[name], expanded[name])
+		}
+	}
+	handlers["DEL"] = handler{1, cmdHybridMapDEL}
+	handlers["UNLINK"] = handler{1, cmdHybridMapUNLINK}
+	return handlers
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Size bin maintained by the redis.lua list functions.
+// The list itself is stored in the same bin by redis.lua and by the native
+// list operations, so legacy records are readable as is. The stale size bin
+// is removed by the first native write.
+const legacySizeBinName = binName + "_size"
+
+// listIsEmpty returns true if the error means there is nothing at the
+// requested position: missing record, missing bin or index out of bounds.
+func listIsEmpty(err error) bool {
+	switch errResultCode(err) {
+	case ase.KEY_NOT_FOUND_ERROR, ase.BIN_NOT_FOUND, ase.PARAMETER_ERROR:
+		return true
+	}
+	return false
+}
+
+// listRange converts Redis inclusive start / stop offsets, which can be
+// negative, to an Aerospike index and count, for a list of the given size.
+func listRange(start int, stop int, size int) (int, int) {
+	if start < 0 {
+		start += size
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop += size
+	}
+	if stop >= size {
+		stop = size - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop - start + 1
+}
+
+func listSize(ctx *context, key *as.Key) (int, error) {
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, as.ListSizeOp(binName))
+	if err != nil {
+		if listIsEmpty(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if rec == nil || rec.Bins[binName] == nil {
+		return 0, nil
+	}
+	size, ok := rec.Bins[binName].(int)
+	if !ok {
+		return 0, errWrongType
+	}
+	return size, nil
+}
+
+// listBounds resolves start / stop to an index and a count. Positive offsets
+// are sent as is, the server clamps them. Negative offsets need the list size,
+// which costs an additional read.
+func listBounds(ctx *context, key *as.Key, start int, stop int) (int, int, error) {
+	if start >= 0 && stop >= 0 {
+		if start > stop {
+			return 0, 0, nil
+		}
+		return start, stop - start + 1, nil
+	}
+	size, err := listSize(ctx, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	index, count := listRange(start, stop, size)
+	return index, count, nil
+}
+
+func listPushOp(left bool, values []interface{}) *as.Operation {
+	if left {
+		return as.ListInsertOp(binName, 0, values...)
+	}
+	return as.ListAppendOp(binName, values...)
+}
+
+func arrayPush(wf io.Writer, ctx *context, k []byte, values [][]byte, left bool, ttl int, action as.RecordExistsAction) error {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return err
+	}
+	a := make([]interface{}, len(values))
+	for i, v := range values {
+		if left {
+			// LPUSH a b c gives c b a
+			a[len(values)-1-i] = encode(ctx, v)
+		} else {
+			a[i] = encode(ctx, v)
+		}
+	}
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttl, action), key, listPushOp(left, a), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	if err != nil {
+		if action == as.UPDATE_ONLY && errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return writeLine(wf, ":0")
+		}
+		return err
+	}
+	ctx.listWaiters.notify(string(k))
+	return writeBinInt(wf, rec, binName)
+}
+
+func cmdRPUSH(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPush(wf, ctx, args[0], args[1:], false, -1, as.UPDATE)
+}
+
+func cmdRPUSHX(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPush(wf, ctx, args[0], args[1:], false, -1, as.UPDATE_ONLY)
+}
+
+func cmdRPUSHEX(wf io.Writer, ctx *context, args [][]byte) error {
+	ttl, err := strconv.Atoi(string(args[len(args)-1]))
+	if err != nil {
+		return err
+	}
+
+	return arrayPush(wf, ctx, args[0], args[1:len(args)-1], false, ttl, as.UPDATE)
+}
+
+func cmdLPUSH(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPush(wf, ctx, args[0], args[1:], true, -1, as.UPDATE)
+}
+
+func cmdLPUSHX(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPush(wf, ctx, args[0], args[1:], true, -1, as.UPDATE_ONLY)
+}
+
+func cmdLPUSHEX(wf io.Writer, ctx *context, args [][]byte) error {
+	ttl, err := strconv.Atoi(string(args[len(args)-1]))
+	if err != nil {
+		return err
+	}
+
+	return arrayPush(wf, ctx, args[0], args[1:len(args)-1], true, ttl, as.UPDATE)
+}
+
+// listPopRange pops count elements from the head or the tail of the list,
+// and returns them in pop order. An empty result means the list was empty or
+// did not exist.
+func listPopRange(ctx *context, key *as.Key, left bool, count int) ([]interface{}, error) {
+	policy := fillWritePolicyAction(ctx, -1, as.UPDATE_ONLY)
+	index := 0
+	if !left {
+		index = -count
+	}
+	rec, err := ctx.client.Operate(policy, key, as.ListPopRangeOp(binName, index, count), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	if err != nil && errResultCode(err) != ase.KEY_NOT_FOUND_ERROR && listIsEmpty(err) {
+		// count is greater than the list size, pop everything
+		rec, err = ctx.client.Operate(policy, key, as.ListPopRangeFromOp(binName, 0), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	}
+	if err != nil {
+		if listIsEmpty(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if rec == nil || rec.Bins[binName] == nil {
+		return nil, nil
+	}
+	a, ok := rec.Bins[binName].([]interface{})
+	if !ok {
+		return nil, errWrongType
+	}
+	if !left {
+		for i, j := 0, len(a)-1; i < j; i, j = i+1, j-1 {
+			a[i], a[j] = a[j], a[i]
+		}
+	}
+	return a, nil
+}
+
+func arrayPop(wf io.Writer, ctx *context, args [][]byte, left bool) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		a, err := listPopRange(ctx, key, left, 1)
+		if err != nil {
+			return err
+		}
+		if len(a) == 0 {
+			return writeLine(wf, "$-1")
+		}
+		return writeValue(wf, a[0])
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		return writeErrorReply(wf, "ERR value is out of range, must be positive")
+	}
+	if count == 0 {
+		return writeArray(wf, make([]interface{}, 0))
+	}
+	a, err := listPopRange(ctx, key, left, count)
+	if err != nil {
+		return err
+	}
+	if len(a) == 0 {
+		return writeLine(wf, "*-1")
+	}
+	return writeArray(wf, a)
+}
+
+func cmdRPOP(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPop(wf, ctx, args, false)
+}
+
+func cmdLPOP(wf io.Writer, ctx *context, args [][]byte) error {
+	return arrayPop(wf, ctx, args, true)
+}
+
+func cmdLLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	size, err := listSize(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(size))
+}
+
+func cmdLRANGE(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	start, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	stop, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return err
+	}
+	index, count, err := listBounds(ctx, key, start, stop)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return writeArray(wf, make([]interface{}, 0))
+	}
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, as.ListGetRangeOp(binName, index, count))
+	if err != nil {
+		if listIsEmpty(err) {
+			return writeArray(wf, make([]interface{}, 0))
+		}
+		return err
+	}
+	if rec == nil || rec.Bins[binName] == nil {
+		return writeArray(wf, make([]interface{}, 0))
+	}
+	a, ok := rec.Bins[binName].([]interface{})
+	if !ok {
+		return errWrongType
+	}
+	return writeArray(wf, a)
+}
+
+func cmdLTRIM(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	start, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	stop, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return err
+	}
+	index, count, err := listBounds(ctx, key, start, stop)
+	if err != nil {
+		return err
+	}
+	op := as.ListClearOp(binName)
+	if count > 0 {
+		op = as.ListTrimOp(binName, index, count)
+	}
+	policy := fillWritePolicyAction(ctx, -1, as.UPDATE_ONLY)
+	_, err = ctx.client.Operate(policy, key, op, as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	if err != nil {
+		if !listIsEmpty(err) {
+			return err
+		}
+		if count > 0 {
+			// start is after the end of the list
+			_, err = ctx.client.Operate(policy, key, as.ListClearOp(binName), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+			if err != nil && !listIsEmpty(err) {
+				return err
+			}
+		}
+	}
+	return writeLine(wf, "+OK")
+}
+
+func cmdLINDEX(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, as.ListGetOp(binName, index))
+	if err != nil {
+		if listIsEmpty(err) {
+			return writeLine(wf, "$-1")
+		}
+		return err
+	}
+	return writeBin(wf, rec, binName, "$-1")
+}
+
+func cmdLSET(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	reply := "+OK"
+	err = casRetry(func() error {
+		// Aerospike pads the list with nil when setting after the end,
+		// so the index has to be checked against the current size
+		rec, err := ctx.client.Operate(ctx.writePolicy, key, as.ListSizeOp(binName))
+		if err != nil && !listIsEmpty(err) {
+			return err
+		}
+		if err != nil || rec == nil || rec.Bins[binName] == nil {
+			reply = "-ERR no such key"
+			return nil
+		}
+		size, ok := rec.Bins[binName].(int)
+		if !ok {
+			return errWrongType
+		}
+		if index >= size || index < -size {
+			reply = "-ERR index out of range"
+			return nil
+		}
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, -1, rec), key, as.ListSetOp(binName, index, encode(ctx, args[2])), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, reply)
+}
+
+// listGet reads the whole list, with the record generation
+func listGet(ctx *context, key *as.Key) (*as.Record, []interface{}, error) {
+	rec, err := ctx.client.Get(ctx.readPolicy, key, binName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil || rec.Bins[binName] == nil {
+		return rec, nil, nil
+	}
+	a, ok := rec.Bins[binName].([]interface{})
+	if !ok {
+		return nil, nil, errWrongType
+	}
+	return rec, a, nil
+}
+
+// listEqual compares a stored list element with a Redis argument
+func listEqual(x interface{}, value []byte) bool {
+	buf, err := decodeValue(x)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(buf, value)
+}
+
+func cmdLINSERT(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	after := false
+	switch strings.ToUpper(string(args[1])) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	result := 0
+	err = casRetry(func() error {
+		rec, l, err := listGet(ctx, key)
+		if err != nil {
+			return err
+		}
+		if len(l) == 0 {
+			result = 0
+			return nil
+		}
+		index := -1
+		for i, e := range l {
+			if listEqual(e, args[2]) {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			result = -1
+			return nil
+		}
+		if after {
+			index++
+		}
+		res, err := ctx.client.Operate(fillWritePolicyCas(ctx, -1, rec), key, as.ListInsertOp(binName, index, encode(ctx, args[3])), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+		if err != nil {
+			return err
+		}
+		result, _ = res.Bins[binName].(int)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(result))
+}
+
+func cmdLREM(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return err
+	}
+	removed := 0
+	err = casRetry(func() error {
+		rec, l, err := listGet(ctx, key)
+		if err != nil {
+			return err
+		}
+		// indexes to remove, in descending order so that removing one
+		// does not shift the following ones
+		indexes := make([]int, 0)
+		if count >= 0 {
+			for i := 0; i < len(l) && (count == 0 || len(indexes) < count); i++ {
+				if listEqual(l[i], args[2]) {
+					indexes = append([]int{i}, indexes...)
+				}
+			}
+		} else {
+			for i := len(l) - 1; i >= 0 && len(indexes) < -count; i-- {
+				if listEqual(l[i], args[2]) {
+					indexes = append(indexes, i)
+				}
+			}
+		}
+		removed = len(indexes)
+		if removed == 0 {
+			return nil
+		}
+		ops := make([]*as.Operation, 0, len(indexes)+1)
+		for _, i := range indexes {
+			ops = append(ops, as.ListRemoveOp(binName, i))
+		}
+		ops = append(ops, as.PutOp(as.NewBin(legacySizeBinName, nil)))
+		_, err = ctx.client.Operate(fillWritePolicyCas(ctx, -1, rec), key, ops...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(removed))
+}
+
+func cmdLPOS(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	rank := 1
+	count := -1
+	maxLen := 0
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+		v, err := strconv.Atoi(string(args[i+1]))
+		if err != nil {
+			return writeErrorReply(wf, "ERR value is not an integer or out of range")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "RANK":
+			if v == 0 {
+				return writeErrorReply(wf, "ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = v
+		case "COUNT":
+			if v < 0 {
+				return writeErrorReply(wf, "ERR COUNT can't be negative")
+			}
+			count = v
+		case "MAXLEN":
+			if v < 0 {
+				return writeErrorReply(wf, "ERR MAXLEN can't be negative")
+			}
+			maxLen = v
+		default:
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+	}
+	_, l, err := listGet(ctx, key)
+	if err != nil {
+		return err
+	}
+	positions := make([]int, 0)
+	step := 1
+	start := 0
+	skip := rank - 1
+	if rank < 0 {
+		step = -1
+		start = len(l) - 1
+		skip = -rank - 1
+	}
+	for i, n := start, 0; i >= 0 && i < len(l) && (maxLen == 0 || n < maxLen); i, n = i+step, n+1 {
+		if !listEqual(l[i], args[1]) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		positions = append(positions, i)
+		if count == -1 || count > 0 && len(positions) == count {
+			break
+		}
+	}
+	if count == -1 {
+		if len(positions) == 0 {
+			return writeLine(wf, "$-1")
+		}
+		return writeLine(wf, ":"+strconv.Itoa(positions[0]))
+	}
+	err = writeLine(wf, "*"+strconv.Itoa(len(positions)))
+	if err != nil {
+		return err
+	}
+	for _, p := range positions {
+		err = writeLine(wf, ":"+strconv.Itoa(p))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseListSide(b []byte) (bool, bool) {
+	switch strings.ToUpper(string(b)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// listMove pops an element from src and pushes it to dst. This is not atomic:
+// the element is removed from src before being added to dst, and is pushed
+// back to src if the push to dst fails.
+func listMove(ctx *context, src []byte, dst []byte, fromLeft bool, toLeft bool) (interface{}, error) {
+	srcKey, err := buildKey(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	dstKey, err := buildKey(ctx, dst)
+	if err != nil {
+		return nil, err
+	}
+	a, err := listPopRange(ctx, srcKey, fromLeft, 1)
+	if err != nil || len(a) == 0 {
+		return nil, err
+	}
+	_, err = ctx.client.Operate(ctx.writePolicy, dstKey, listPushOp(toLeft, a), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+	if err != nil {
+		_, rollbackErr := ctx.client.Operate(ctx.writePolicy, srcKey, listPushOp(fromLeft, a), as.PutOp(as.NewBin(legacySizeBinName, nil)))
+		if rollbackErr != nil {
+			log.Printf("%s: unable to push back element to %s: %s", ctx.set, string(src), rollbackErr)
+		}
+		return nil, err
+	}
+	ctx.listWaiters.notify(string(dst))
+	return a[0], nil
+}
+
+func cmdLMOVE(wf io.Writer, ctx *context, args [][]byte) error {
+	fromLeft, ok := parseListSide(args[2])
+	if !ok {
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	toLeft, ok := parseListSide(args[3])
+	if !ok {
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	x, err := listMove(ctx, args[0], args[1], fromLeft, toLeft)
+	if err != nil {
+		return err
+	}
+	if x == nil {
+		return writeLine(wf, "$-1")
+	}
+	return writeValue(wf, x)
+}
+
+func cmdRPOPLPUSH(wf io.Writer, ctx *context, args [][]byte) error {
+	x, err := listMove(ctx, args[0], args[1], false, true)
+	if err != nil {
+		return err
+	}
+	if x == nil {
+		return writeLine(wf, "$-1")
+	}
+	return writeValue(wf, x)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Migration of maps from the standard to the expanded layout.
+// With "migrate_from_standard" in the configuration of an expanded map set,
+// read commands fall back to the standard record of a map which has not been
+// migrated yet, and write commands migrate it first: the fields are copied
+// under a new suffixed key, the main record is created, then the standard
+// record is removed, if it has not been modified in the meantime.
+// The migrate-maps subcommand scans the set to migrate all the maps:
+// Usage: aerodis --config_file config.json migrate-maps [--set set] [--rate 100] [--state_file migrate.json]
+// Scans only return the key of records written with send_key: maps written
+// before send_key was set are only migrated by their next write.
+
+// Hash commands which only read the map
+var migrationReadCommands = []string{"HGET", "HMGET", "HGETALL", "HEXISTS", "HLEN", "HKEYS", "HVALS", "HSTRLEN", "HRANDFIELD", "HSCAN", "HTTL", "HPTTL"}
+
+// Hash commands which modify the map
+var migrationWriteCommands = []string{"HSET", "HMSET", "HSETNX", "HDEL", "HINCRBY", "HINCRBYEX", "HINCRBYFLOAT", "HMINCRBYEX", "HEXPIRE", "HPEXPIRE", "HPERSIST"}
+
+// isStandardMap returns true if the record holds a standard map, and not a
+// string or a list. A record whose only bin is the string bin is a string.
+func isStandardMap(rec *as.Record) bool {
+	if len(rec.Bins) == 1 && rec.Bins[binName] != nil {
+		return false
+	}
+	for _, v := range rec.Bins {
+		if _, ok := v.([]interface{}); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// writeExpandedFields writes the field records of the map suffixedKey with
+// the values of a standard map. Field expirations are kept.
+func writeExpandedFields(ctx *context, suffixedKey string, rec *as.Record, values map[string]interface{}, fields []string) error {
+	expirations := fieldExpirations(rec)
+	nowMs := nowMillis()
+	return forEachBounded(len(fields), ctx.batchConcurrency, func(i int) error {
+		field := fields[i]
+		fieldKey, err := formatCompositeKey(ctx, suffixedKey, field)
+		if err != nil {
+			return err
+		}
+		bins := as.BinMap{
+			MAIN_KEY_BIN_NAME:   suffixedKey,
+			SECOND_KEY_BIN_NAME: field,
+			VALUE_BIN_NAME:      values[field],
+			"created_at":        now(),
+		}
+		policy := fillWritePolicyEx(ctx, ctx.expandedMapDefaultTTL, false)
+		if at, ok := expirations[field]; ok {
+			// the field keeps its expiration
+			bins[FIELD_TTL_BIN_NAME] = 1
+			policy = fillWritePolicyEx(ctx, int(ceilDiv(at-nowMs, 1000)), false)
+		}
+		return ctx.client.Put(policy, fieldKey, bins)
+	})
+}
+
+// standardMapFields returns the values and the sorted field names of the
+// standard map rec
+func standardMapFields(rec *as.Record) (map[string]interface{}, []string) {
+	values := hashValues(rec)
+	delete(values, SPILLED_BIN_NAME)
+	return values, sortedFields(values)
+}
+
+// copyToExpanded copies the fields of the standard map k, read as rec, to a
+// new expanded map. The field records are written under a new suffixed key
+// before the main record is created, so readers never see a partially
+// copied map. Returns false, after having removed the copy, if an expanded
+// map already exists for k.
+func copyToExpanded(ctx *context, k []byte, rec *as.Record) (bool, error) {
+	ttl := -1
+	if rec.Expiration != ttlNeverExpire {
+		ttl = int(rec.Expiration)
+	}
+	values, fields := standardMapFields(rec)
+	suffixedKey := string(k) + "_" + randStringBytes(8)
+	discard := func() {
+		_, err := expandedMapDeleteFields(ctx, expandedMapDeletion{suffixedKey: suffixedKey, fields: fields}, 0)
+		if err != nil {
+			log.Printf("%s: unable to delete fields of %s: %s", ctx.set, suffixedKey, err)
+		}
+	}
+	err := writeExpandedFields(ctx, suffixedKey, rec, values, fields)
+	if err != nil {
+		discard()
+		return false, err
+	}
+	key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+	if err != nil {
+		return false, err
+	}
+	ops := []*as.Operation{
+		as.PutOp(as.NewBin(ROOT_BIN_NAME, suffixedKey)),
+		as.PutOp(as.NewBin("created_at", now())),
+	}
+	// larger maps use the secondary index
+	directory := ctx.expandedMapDirectoryLimit <= 0 || len(fields) <= ctx.expandedMapDirectoryLimit
+	if directory {
+		ops = append(ops, as.PutOp(as.NewBin(DIRECTORY_BIN_NAME, 1)))
+	}
+	if directory && len(fields) > 0 {
+		items := make(map[interface{}]interface{}, len(fields))
+		for _, f := range fields {
+			items[f] = 1
+		}
+		ops = append(ops, as.MapPutItemsOp(expandedMapDirectoryPolicy, FIELDS_BIN_NAME, items))
+	}
+	_, err = ctx.client.Operate(fillWritePolicyEx(ctx, ttl, true), key, ops...)
+	if err != nil {
+		discard()
+		if errResultCode(err) == ase.KEY_EXISTS_ERROR {
+			return false, nil
+		}
+		return false, err
+	}
+	cacheSet(ctx, string(k), suffixedKey)
+	cacheNotifyPeers(ctx, "create", string(k))
+	return true, nil
+}
+
+// migrateMap copies the standard map k to the expanded layout, then removes
+// the standard record. Returns false if there was no standard map to
+// migrate, or if another command has migrated it. If the standard record
+// has been modified during the copy, the copy is removed and done again.
+func migrateMap(ctx *context, k []byte) (bool, error) {
+	key, err := buildKey(ctx, k)
+	if err != nil {
+		return false, err
+	}
+	migrated := false
+	err = casRetry(func() error {
+		rec, err := ctx.client.Get(ctx.readPolicy, key)
+		if err != nil {
+			return err
+		}
+		migrated = rec != nil && isStandardMap(rec)
+		if !migrated {
+			return nil
+		}
+		migrated, err = copyToExpanded(ctx, k, rec)
+		if err != nil || !migrated {
+			return err
+		}
+		_, err = ctx.client.Delete(fillWritePolicyCas(ctx, -1, rec), key)
+		if errResultCode(err) == ase.GENERATION_ERROR {
+			_, delErr := expandedMapDelete(ctx, k, false)
+			if delErr != nil {
+				return delErr
+			}
+		}
+		return err
+	})
+	return migrated, err
+}
+
+// migrationHandlers makes the hash commands of an expanded map set use the
+// standard map of a key until it is migrated
+func migrationHandlers(handlers map[string]handler) map[string]handler {
+	standard := standardHandlers()
+	for _, name := range migrationReadCommands {
+		expanded := handlers[name]
+		old := standard[name]
+		handlers[name] = handler{expanded.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+			suffixedKey, err := compositeExists(ctx, string(args[0]))
+			if err != nil {
+				return err
+			}
+			if suffixedKey == nil {
+				return old.f(wf, ctx, args)
+			}
+			return expanded.f(wf, ctx, args)
+		}}
+	}
+	for _, name := range migrationWriteCommands {
+		expanded := handlers[name]
+		handlers[name] = handler{expanded.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+			// a negative cache entry does not prevent the migration, as the
+			// map may have been created since
+			suffixedKey, err := compositeLookup(ctx, string(args[0]), true)
+			if err != nil {
+				return err
+			}
+			if suffixedKey == nil {
+				_, err = migrateMap(ctx, args[0])
+				if err != nil {
+					return err
+				}
+			}
+			return expanded.f(wf, ctx, args)
+		}}
+	}
+	return handlers
+}
+
+type migrationStats struct {
+	scanned  int
+	migrated int
+	// records whose key has not been stored
+	noKey int
+}
+
+// migrationState lists, for each set, the nodes whose scan is complete
+type migrationState map[string][]string
+
+func loadMigrationState(file string) migrationState {
+	state := make(migrationState)
+	if file == "" {
+		return state
+	}
+	buf, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return state
+	}
+	if err != nil {
+		log.Fatalf("Unable to read %s: %s", file, err)
+	}
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		log.Fatalf("Unable to parse %s: %s", file, err)
+	}
+	return state
+}
+
+func saveMigrationState(file string, state migrationState) {
+	if file == "" {
+		return
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		log.Fatalf("Unable to encode migration state: %s", err)
+	}
+	err = ioutil.WriteFile(file, buf, 0644)
+	if err != nil {
+		log.Fatalf("Unable to write %s: %s", file, err)
+	}
+}
+
+// migrateNode migrates the standard maps stored on a node, at most rate per
+// second if rate is positive
+func migrateNode(ctx *context, node *as.Node, rate int, stats *migrationStats) error {
+	var throttle <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+	recordset, err := ctx.client.ScanNode(as.NewScanPolicy(), node, ctx.ns, ctx.set)
+	if err != nil {
+		return err
+	}
+	defer recordset.Close()
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return res.Err
+		}
+		stats.scanned++
+		select {
+		case <-progress.C:
+			log.Printf("%s: node %s, %d records scanned, %d maps migrated", ctx.set, node.GetName(), stats.scanned, stats.migrated)
+		default:
+		}
+		if res.Record.Key.Value() == nil {
+			stats.noKey++
+			continue
+		}
+		k := res.Record.Key.Value().String()
+		if strings.HasPrefix(k, "composite_") || !isStandardMap(res.Record) {
+			continue
+		}
+		if throttle != nil {
+			<-throttle
+		}
+		migrated, err := migrateMap(ctx, []byte(k))
+		if err != nil {
+			if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+				continue
+			}
+			return err
+		}
+		if migrated {
+			stats.migrated++
+		}
+	}
+	return nil
+}
+
+// migrateMain runs the migrate-maps subcommand on the sets of the
+// configuration with migrate_from_standard
+func migrateMain(client *as.Client, ns string, readPolicy *as.BasePolicy, writePolicy *as.WritePolicy, sets []interface{}, args []string) {
+	flags := flag.NewFlagSet("migrate-maps", flag.ExitOnError)
+	onlySet := flags.String("set", "", "Set to migrate, default all sets with migrate_from_standard")
+	rate := flags.Int("rate", 100, "Max migrated maps per second, 0 for no limit")
+	stateFile := flags.String("state_file", "", "File storing the progress, to resume an interrupted migration")
+	flags.Parse(args)
+
+	state := loadMigrationState(*stateFile)
+	for _, c := range sets {
+		m := c.(map[string]interface{})
+		set := m["set"].(string)
+		if *onlySet != "" && set != *onlySet {
+			continue
+		}
+		if setMapMode(m) != "expanded" || m["migrate_from_standard"] == nil {
+			continue
+		}
+		ctx := context{
+			client:                    client,
+			ns:                        ns,
+			set:                       set,
+			readPolicy:                readPolicy,
+			writePolicy:               writePolicy,
+			batchConcurrency:          16,
+			expandedMapDefaultTTL:     3600 * 24 * 31,
+			expandedMapDirectoryLimit: 10000,
+		}
+		if m["directory_limit"] != nil {
+			ctx.expandedMapDirectoryLimit = getIntFromJson(m["directory_limit"])
+		}
+		if m["default_ttl"] != nil {
+			ctx.expandedMapDefaultTTL = getIntFromJson(m["default_ttl"])
+		}
+		if m["batch_concurrency"] != nil {
+			ctx.batchConcurrency = getIntFromJson(m["batch_concurrency"])
+		}
+		if m["send_key"] != nil {
+			setSendKey(&ctx)
+		}
+		done := make(map[string]bool)
+		for _, n := range state[set] {
+			done[n] = true
+		}
+		stats := migrationStats{}
+		for _, node := range client.GetNodes() {
+			if done[node.GetName()] {
+				log.Printf("%s: node %s already migrated", set, node.GetName())
+				continue
+			}
+			log.Printf("%s: Migrating maps of node %s, rate %d", set, node.GetName(), *rate)
+			err := migrateNode(&ctx, node, *rate, &stats)
+			if err != nil {
+				log.Fatalf("%s: Migration failed on node %s: %s", set, node.GetName(), err)
+			}
+			state[set] = append(state[set], node.GetName())
+			saveMigrationState(*stateFile, state)
+		}
+		log.Printf("%s: %d records scanned, %d maps migrated, %d records without stored key", set, stats.scanned, stats.migrated, stats.noKey)
+	}
+}
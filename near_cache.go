@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	as "github.com/aerospike/aerospike-client-go"
+	"github.com/coocood/freecache"
+)
+
+// Near cache: with "near_cache_size" in the configuration of a set, the
+// replies of GET, HGET, HGETALL and LRANGE are kept in memory, at most
+// near_cache_ttl seconds and the TTL of the record. Each key has a version,
+// changed before and after every write to the key through this instance.
+// Replies are cached under the version read before the command, so a reply
+// read during a write is never used after it. Writes through other
+// instances are seen after near_cache_ttl. Listeners of the same namespace
+// and set share their cache.
+
+type nearCache struct {
+	// last version, first for 64 bits alignment
+	version  uint64
+	cache    *freecache.Cache
+	ttl      int
+	prefixes [][]byte
+	hits     uint32
+	misses   uint32
+}
+
+// near caches by namespace and set
+var nearCaches = make(map[string]*nearCache)
+
+// Cached commands, except hash commands when fields can expire
+var nearCacheCommands = []string{"GET", "HGET", "HGETALL", "LRANGE"}
+
+// Commands which do not modify their keys
+var nearCacheReadOnlyCommands = []string{"GET", "MGET", "STRLEN", "GETRANGE", "LLEN", "LRANGE", "LINDEX", "LPOS", "HGET", "HMGET", "HGETALL", "HEXISTS", "HLEN", "HKEYS", "HVALS", "HSTRLEN", "HRANDFIELD", "HSCAN", "HTTL", "HPTTL", "TTL", "PTTL", "EXPIRETIME", "PEXPIRETIME", "HOTKEYS", "SCAN", "KEYS"}
+
+// nearCacheWrittenKeys returns the keys a command can modify
+func nearCacheWrittenKeys(cmd string, args [][]byte) [][]byte {
+	switch cmd {
+	case "DEL", "UNLINK", "BLPOP", "BRPOP":
+		return args
+	case "MSET":
+		keys := make([][]byte, 0, (len(args)+1)/2)
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "LMOVE", "RPOPLPUSH", "BLMOVE", "BRPOPLPUSH":
+		return args[:2]
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args[:1]
+}
+
+// allowed returns true if the key matches the prefix allow-list
+func (c *nearCache) allowed(k []byte) bool {
+	if len(c.prefixes) == 0 {
+		return true
+	}
+	for _, p := range c.prefixes {
+		if bytes.HasPrefix(k, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func nearCacheVersionKey(k []byte) []byte {
+	return append([]byte("\x00v"), k...)
+}
+
+// keyVersion returns the version of the key k, a new one if it has been
+// evicted
+func (c *nearCache) keyVersion(k []byte) []byte {
+	v, err := c.cache.Get(nearCacheVersionKey(k))
+	if err == nil && len(v) == 8 {
+		return v
+	}
+	return c.bump(k)
+}
+
+// bump gives a new version to the key k, so its cached replies are not used
+// anymore. Versions are never reused.
+func (c *nearCache) bump(k []byte) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, atomic.AddUint64(&c.version, 1))
+	// kept until evicted
+	c.cache.Set(nearCacheVersionKey(k), v, 0)
+	return v
+}
+
+// nearCacheEntryKey returns the cache key of a command, arguments are
+// prefixed by their length
+func nearCacheEntryKey(cmd string, version []byte, args [][]byte) []byte {
+	buf := bytes.NewBufferString(cmd)
+	buf.Write(version)
+	l := make([]byte, 4)
+	for _, a := range args {
+		binary.BigEndian.PutUint32(l, uint32(len(a)))
+		buf.Write(l)
+		buf.Write(a)
+	}
+	return buf.Bytes()
+}
+
+// entryTTL returns the TTL of a reply of the command name about the key k,
+// 0 if the key expires now or if its TTL cannot be read. The TTL of an
+// expanded map is the one of its main record. Without main record, the map
+// may be a standard record (hybrid mode, migration).
+func (c *nearCache) entryTTL(ctx *context, name string, k []byte) int {
+	var rec *as.Record
+	if (ctx.mapMode == "expanded" || ctx.mapMode == "hybrid") && (name == "HGET" || name == "HGETALL") {
+		key, err := formatCompositeKey(ctx, string(k), MAIN_SUFFIX)
+		if err != nil {
+			return 0
+		}
+		rec, err = ctx.client.GetHeader(ctx.readPolicy, key)
+		if err != nil {
+			return 0
+		}
+	}
+	if rec == nil {
+		key, err := buildKey(ctx, k)
+		if err != nil {
+			return 0
+		}
+		rec, err = ctx.client.GetHeader(ctx.readPolicy, key)
+		if err != nil {
+			return 0
+		}
+	}
+	if rec != nil && rec.Expiration != ttlNeverExpire && int64(rec.Expiration) < int64(c.ttl) {
+		return int(rec.Expiration)
+	}
+	return c.ttl
+}
+
+func (c *nearCache) read(name string, h handler) handler {
+	return handler{h.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		if !c.allowed(args[0]) {
+			return h.f(wf, ctx, args)
+		}
+		entry := nearCacheEntryKey(name, c.keyVersion(args[0]), args)
+		if v, err := c.cache.Get(entry); err == nil {
+			atomic.AddUint32(&c.hits, 1)
+			return write(wf, v)
+		}
+		atomic.AddUint32(&c.misses, 1)
+		buf := bytes.NewBuffer(nil)
+		err := h.f(buf, ctx, args)
+		if err != nil {
+			return err
+		}
+		reply := buf.Bytes()
+		// error replies are not cached
+		if len(reply) > 0 && reply[0] != '-' {
+			if ttl := c.entryTTL(ctx, name, args[0]); ttl > 0 {
+				c.cache.Set(entry, reply, ttl)
+			}
+		}
+		return write(wf, reply)
+	}}
+}
+
+func (c *nearCache) write(name string, h handler) handler {
+	return handler{h.argsCount, func(wf io.Writer, ctx *context, args [][]byte) error {
+		keys := nearCacheWrittenKeys(name, args)
+		// before the write, so a read started before it is not used once
+		// the write has replied
+		for _, k := range keys {
+			if c.allowed(k) {
+				c.bump(k)
+			}
+		}
+		err := h.f(wf, ctx, args)
+		// and after the write, so a concurrent read cannot cache the old
+		// value under the new version
+		if name == "FLUSHDB" {
+			c.cache.Clear()
+		}
+		for _, k := range keys {
+			if c.allowed(k) {
+				c.bump(k)
+			}
+		}
+		return err
+	}}
+}
+
+// sendStats sends the hits and misses since the last call
+func (c *nearCache) sendStats(conn *net.UDPConn, prefix string) {
+	hits := atomic.SwapUint32(&c.hits, 0)
+	misses := atomic.SwapUint32(&c.misses, 0)
+	udpSend(conn, prefix+"near_cache.hit:"+strconv.Itoa(int(hits))+"|c")
+	udpSend(conn, prefix+"near_cache.miss:"+strconv.Itoa(int(misses))+"|c")
+}
+
+// sharedNearCache returns the near cache of the namespace and the set of
+// ctx, created with the configuration of the first listener
+func sharedNearCache(ctx *context, config map[string]interface{}) *nearCache {
+	name := ctx.ns + "." + ctx.set
+	if c := nearCaches[name]; c != nil {
+		log.Printf("%s: Sharing the near cache of %s", ctx.set, name)
+		return c
+	}
+	size := getIntFromJson(config["near_cache_size"])
+	c := &nearCache{
+		cache: freecache.NewCache(size),
+		ttl:   10,
+	}
+	if config["near_cache_ttl"] != nil {
+		c.ttl = getIntFromJson(config["near_cache_ttl"])
+	}
+	if config["near_cache_prefixes"] != nil {
+		for _, p := range config["near_cache_prefixes"].([]interface{}) {
+			c.prefixes = append(c.prefixes, []byte(p.(string)))
+		}
+	}
+	nearCaches[name] = c
+	log.Printf("%s: Using a near cache of %d bytes, ttl %d, prefixes %v", ctx.set, size, c.ttl, config["near_cache_prefixes"])
+	return c
+}
+
+func nearCacheHandlers(handlers map[string]handler, config map[string]interface{}, ctx *context) map[string]handler {
+	if config["near_cache_size"] == nil {
+		return handlers
+	}
+	ctx.nearCache = sharedNearCache(ctx, config)
+	c := ctx.nearCache
+
+	cached := make(map[string]bool)
+	for _, name := range nearCacheCommands {
+		if ctx.hashFieldTTL && (name == "HGET" || name == "HGETALL") {
+			continue
+		}
+		cached[name] = true
+	}
+	readOnly := make(map[string]bool)
+	for _, name := range nearCacheReadOnlyCommands {
+		readOnly[name] = true
+	}
+	wrapped := make(map[string]handler, len(handlers))
+	for name, h := range handlers {
+		if cached[name] {
+			wrapped[name] = c.read(name, h)
+		} else if readOnly[name] {
+			wrapped[name] = h
+		} else {
+			wrapped[name] = c.write(name, h)
+		}
+	}
+	return wrapped
+}
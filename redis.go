@@ -20,7 +20,7 @@ import (
 	"time"
 
 	as "github.com/aerospike/aerospike-client-go"
-	"github.com/coocood/freecache"
+	ase "github.com/aerospike/aerospike-client-go/types"
 )
 
 const binName = "r"
@@ -29,26 +29,49 @@ const MODULE_NAME = "redis"
 func standardHandlers() map[string]handler {
 	handlers := make(map[string]handler)
 	handlers["DEL"] = handler{1, cmdDEL}
+	handlers["UNLINK"] = handler{1, cmdDEL}
 	handlers["GET"] = handler{1, cmdGET}
 	handlers["SET"] = handler{2, cmdSET}
 	handlers["SETEX"] = handler{3, cmdSETEX}
 	handlers["SETNXEX"] = handler{3, cmdSETNXEX}
 	handlers["SETNX"] = handler{2, cmdSETNX}
+	handlers["GETSET"] = handler{2, cmdGETSET}
+	handlers["GETDEL"] = handler{1, cmdGETDEL}
+	handlers["GETEX"] = handler{1, cmdGETEX}
+	handlers["APPEND"] = handler{2, cmdAPPEND}
+	handlers["STRLEN"] = handler{1, cmdSTRLEN}
+	handlers["GETRANGE"] = handler{3, cmdGETRANGE}
+	handlers["SETRANGE"] = handler{3, cmdSETRANGE}
 	handlers["MGET"] = handler{2, cmdMGET}
 	handlers["MSET"] = handler{2, cmdMSET}
 	handlers["LLEN"] = handler{1, cmdLLEN}
 	handlers["RPUSH"] = handler{2, cmdRPUSH}
 	handlers["LPUSH"] = handler{2, cmdLPUSH}
+	handlers["RPUSHX"] = handler{2, cmdRPUSHX}
+	handlers["LPUSHX"] = handler{2, cmdLPUSHX}
 	handlers["RPUSHEX"] = handler{3, cmdRPUSHEX}
 	handlers["LPUSHEX"] = handler{3, cmdLPUSHEX}
 	handlers["RPOP"] = handler{1, cmdRPOP}
 	handlers["LPOP"] = handler{1, cmdLPOP}
 	handlers["LRANGE"] = handler{3, cmdLRANGE}
 	handlers["LTRIM"] = handler{3, cmdLTRIM}
+	handlers["LINDEX"] = handler{2, cmdLINDEX}
+	handlers["LSET"] = handler{3, cmdLSET}
+	handlers["LINSERT"] = handler{4, cmdLINSERT}
+	handlers["LREM"] = handler{3, cmdLREM}
+	handlers["LPOS"] = handler{2, cmdLPOS}
+	handlers["LMOVE"] = handler{4, cmdLMOVE}
+	handlers["RPOPLPUSH"] = handler{2, cmdRPOPLPUSH}
+	handlers["BLPOP"] = handler{2, cmdBLPOP}
+	handlers["BRPOP"] = handler{2, cmdBRPOP}
+	handlers["BLMOVE"] = handler{5, cmdBLMOVE}
+	handlers["BRPOPLPUSH"] = handler{3, cmdBRPOPLPUSH}
 	handlers["INCR"] = handler{1, cmdINCR}
 	handlers["INCRBY"] = handler{2, cmdINCRBY}
 	handlers["HINCRBY"] = handler{3, cmdHINCRBY}
 	handlers["HINCRBYEX"] = handler{4, cmdHINCRBYEX}
+	handlers["INCRBYFLOAT"] = handler{2, cmdINCRBYFLOAT}
+	handlers["HINCRBYFLOAT"] = handler{3, cmdHINCRBYFLOAT}
 	handlers["DECR"] = handler{1, cmdDECR}
 	handlers["DECRBY"] = handler{2, cmdDECRBY}
 	handlers["HGET"] = handler{2, cmdHGET}
@@ -58,17 +81,42 @@ func standardHandlers() map[string]handler {
 	handlers["HMSET"] = handler{3, cmdHMSET}
 	handlers["HMINCRBYEX"] = handler{2, cmdHMINCRBYEX}
 	handlers["HGETALL"] = handler{1, cmdHGETALL}
+	handlers["HEXISTS"] = handler{2, cmdHEXISTS}
+	handlers["HLEN"] = handler{1, cmdHLEN}
+	handlers["HKEYS"] = handler{1, cmdHKEYS}
+	handlers["HVALS"] = handler{1, cmdHVALS}
+	handlers["HSETNX"] = handler{3, cmdHSETNX}
+	handlers["HSTRLEN"] = handler{2, cmdHSTRLEN}
+	handlers["HRANDFIELD"] = handler{1, cmdHRANDFIELD}
+	handlers["HSCAN"] = handler{2, cmdHSCAN}
+	handlers["HEXPIRE"] = handler{5, cmdHEXPIRE}
+	handlers["HPEXPIRE"] = handler{5, cmdHPEXPIRE}
+	handlers["HTTL"] = handler{4, cmdHTTL}
+	handlers["HPTTL"] = handler{4, cmdHPTTL}
+	handlers["HPERSIST"] = handler{4, cmdHPERSIST}
 	handlers["EXPIRE"] = handler{2, cmdEXPIRE}
+	handlers["PEXPIRE"] = handler{2, cmdPEXPIRE}
+	handlers["EXPIREAT"] = handler{2, cmdEXPIREAT}
+	handlers["PEXPIREAT"] = handler{2, cmdPEXPIREAT}
 	handlers["TTL"] = handler{1, cmdTTL}
+	handlers["PTTL"] = handler{1, cmdPTTL}
+	handlers["EXPIRETIME"] = handler{1, cmdEXPIRETIME}
+	handlers["PEXPIRETIME"] = handler{1, cmdPEXPIRETIME}
+	handlers["PERSIST"] = handler{1, cmdPERSIST}
 	handlers["FLUSHDB"] = handler{0, cmdFLUSHDB}
+	handlers["HOTKEYS"] = handler{0, cmdHOTKEYS}
+	handlers["SCAN"] = handler{1, cmdSCAN}
+	handlers["KEYS"] = handler{1, cmdKEYS}
 	return handlers
 }
 
 func expandedMapHandlers() map[string]handler {
 	handlers := standardHandlers()
 	handlers["DEL"] = handler{1, cmdExpandedMapDEL}
+	handlers["UNLINK"] = handler{1, cmdExpandedMapUNLINK}
 	handlers["HINCRBY"] = handler{3, cmdExpandedMapHINCRBY}
 	handlers["HINCRBYEX"] = handler{4, cmdExpandedMapHINCRBYEX}
+	handlers["HINCRBYFLOAT"] = handler{3, cmdExpandedMapHINCRBYFLOAT}
 	handlers["HGET"] = handler{2, cmdExpandedMapHGET}
 	handlers["HSET"] = handler{3, cmdExpandedMapHSET}
 	handlers["HDEL"] = handler{2, cmdExpandedMapHDEL}
@@ -76,11 +124,71 @@ func expandedMapHandlers() map[string]handler {
 	handlers["HMSET"] = handler{3, cmdExpandedMapHMSET}
 	handlers["HMINCRBYEX"] = handler{2, cmdExpandedMapHMINCRBYEX}
 	handlers["HGETALL"] = handler{1, cmdExpandedMapHGETALL}
+	handlers["HEXISTS"] = handler{2, cmdExpandedMapHEXISTS}
+	handlers["HLEN"] = handler{1, cmdExpandedMapHLEN}
+	handlers["HKEYS"] = handler{1, cmdExpandedMapHKEYS}
+	handlers["HVALS"] = handler{1, cmdExpandedMapHVALS}
+	handlers["HSETNX"] = handler{3, cmdExpandedMapHSETNX}
+	handlers["HSTRLEN"] = handler{2, cmdExpandedMapHSTRLEN}
+	handlers["HRANDFIELD"] = handler{1, cmdExpandedMapHRANDFIELD}
+	handlers["HSCAN"] = handler{2, cmdExpandedMapHSCAN}
+	handlers["HEXPIRE"] = handler{5, cmdExpandedMapHEXPIRE}
+	handlers["HPEXPIRE"] = handler{5, cmdExpandedMapHPEXPIRE}
+	handlers["HTTL"] = handler{4, cmdExpandedMapHTTL}
+	handlers["HPTTL"] = handler{4, cmdExpandedMapHPTTL}
+	handlers["HPERSIST"] = handler{4, cmdExpandedMapHPERSIST}
 	handlers["EXPIRE"] = handler{2, cmdExpandedMapEXPIRE}
+	handlers["PEXPIRE"] = handler{2, cmdExpandedMapPEXPIRE}
+	handlers["EXPIREAT"] = handler{2, cmdExpandedMapEXPIREAT}
+	handlers["PEXPIREAT"] = handler{2, cmdExpandedMapPEXPIREAT}
 	handlers["TTL"] = handler{1, cmdExpandedMapTTL}
+	handlers["PTTL"] = handler{1, cmdExpandedMapPTTL}
+	handlers["EXPIRETIME"] = handler{1, cmdExpandedMapEXPIRETIME}
+	handlers["PEXPIRETIME"] = handler{1, cmdExpandedMapPEXPIRETIME}
+	handlers["PERSIST"] = handler{1, cmdExpandedMapPERSIST}
 	return handlers
 }
 
+func cdtMapHandlers() map[string]handler {
+	handlers := standardHandlers()
+	handlers["HGET"] = handler{2, cmdCdtMapHGET}
+	handlers["HSET"] = handler{3, cmdCdtMapHSET}
+	handlers["HSETNX"] = handler{3, cmdCdtMapHSETNX}
+	handlers["HDEL"] = handler{2, cmdCdtMapHDEL}
+	handlers["HMGET"] = handler{2, cmdCdtMapHMGET}
+	handlers["HMSET"] = handler{3, cmdCdtMapHMSET}
+	handlers["HGETALL"] = handler{1, cmdCdtMapHGETALL}
+	handlers["HEXISTS"] = handler{2, cmdCdtMapHEXISTS}
+	handlers["HSTRLEN"] = handler{2, cmdCdtMapHSTRLEN}
+	handlers["HLEN"] = handler{1, cmdCdtMapHLEN}
+	handlers["HKEYS"] = handler{1, cmdCdtMapHKEYS}
+	handlers["HVALS"] = handler{1, cmdCdtMapHVALS}
+	handlers["HRANDFIELD"] = handler{1, cmdCdtMapHRANDFIELD}
+	handlers["HSCAN"] = handler{2, cmdCdtMapHSCAN}
+	handlers["HINCRBY"] = handler{3, cmdCdtMapHINCRBY}
+	handlers["HINCRBYEX"] = handler{4, cmdCdtMapHINCRBYEX}
+	handlers["HMINCRBYEX"] = handler{2, cmdCdtMapHMINCRBYEX}
+	handlers["HINCRBYFLOAT"] = handler{3, cmdCdtMapHINCRBYFLOAT}
+	handlers["HEXPIRE"] = handler{5, cmdCdtMapHEXPIRE}
+	handlers["HPEXPIRE"] = handler{5, cmdCdtMapHPEXPIRE}
+	handlers["HTTL"] = handler{4, cmdCdtMapHTTL}
+	handlers["HPTTL"] = handler{4, cmdCdtMapHPTTL}
+	handlers["HPERSIST"] = handler{4, cmdCdtMapHPERSIST}
+	return handlers
+}
+
+// setMapMode returns the map implementation of a set: standard, expanded,
+// cdt or hybrid
+func setMapMode(m map[string]interface{}) string {
+	if m["expanded_map"] != nil {
+		return "expanded"
+	}
+	if m["map_mode"] != nil {
+		return m["map_mode"].(string)
+	}
+	return "standard"
+}
+
 func getIntFromJson(x interface{}) int {
 	switch x.(type) {
 	case string:
@@ -93,15 +201,6 @@ func getIntFromJson(x interface{}) int {
 	return int(x.(float64))
 }
 
-func displayExpandedMapCacheStat(ctx *context) {
-	for {
-		time.Sleep(time.Duration(300) * time.Second)
-
-		log.Printf("%s: cache ratio %d %.2f %%", ctx.set, ctx.expandedMapCache.LookupCount(), ctx.expandedMapCache.HitRate()*100)
-		ctx.expandedMapCache.ResetStatistics()
-	}
-}
-
 func main() {
 	// to change the flags on the default logger
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -166,10 +265,22 @@ func main() {
 	writePolicy := as.NewWritePolicy(0, 0)
 	fillWritePolicy(writePolicy)
 
-	var wg sync.WaitGroup
-
 	sets := m["sets"]
 
+	switch flag.Arg(0) {
+	case "":
+	case "gc":
+		gcMain(client, *ns, readPolicy, writePolicy, sets.([]interface{}), flag.Args()[1:])
+		return
+	case "migrate-maps":
+		migrateMain(client, *ns, readPolicy, writePolicy, sets.([]interface{}), flag.Args()[1:])
+		return
+	default:
+		log.Fatalf("Unknown command %s", flag.Arg(0))
+	}
+
+	var wg sync.WaitGroup
+
 	statsdConfig := m["statsd"]
 
 	for _, c := range sets.([]interface{}) {
@@ -204,34 +315,154 @@ func main() {
 			backwardWriteCompat = true
 			log.Printf("%s: Write backward compat", set)
 		}
-		ctx := context{client, *ns, set, readPolicy, writePolicy, backwardWriteCompat, 0, 0, 0, 0, nil, 0}
+		legacyIntegerEncoding := false
+		if m["legacy_integer_encoding"] != nil {
+			legacyIntegerEncoding = true
+			log.Printf("%s: Legacy integer encoding", set)
+		}
+		hashFieldTTL := false
+		if m["hash_field_ttl"] != nil {
+			hashFieldTTL = true
+			log.Printf("%s: Hash field expiration", set)
+		}
+		ctx := context{
+			client:                client,
+			ns:                    *ns,
+			set:                   set,
+			readPolicy:            readPolicy,
+			writePolicy:           writePolicy,
+			backwardWriteCompat:   backwardWriteCompat,
+			legacyIntegerEncoding: legacyIntegerEncoding,
+			hashFieldTTL:          hashFieldTTL,
+			batchStats:            newBatchStats(),
+			batchConcurrency:      16,
+			listWaiters:           newListWaiters(),
+			blockingPollMin:       time.Duration(10) * time.Millisecond,
+			blockingPollMax:       time.Duration(1000) * time.Millisecond,
+		}
+		if m["batch_concurrency"] != nil {
+			ctx.batchConcurrency = getIntFromJson(m["batch_concurrency"])
+		}
+		if m["send_key"] != nil {
+			setSendKey(&ctx)
+			log.Printf("%s: Storing user keys", set)
+		}
+		if m["keys_limit"] != nil {
+			ctx.keysLimit = getIntFromJson(m["keys_limit"])
+		}
+		if m["scan_min_count"] != nil {
+			ctx.scanMinCount = getIntFromJson(m["scan_min_count"])
+		}
+		if m["blocking_poll_min_ms"] != nil {
+			ctx.blockingPollMin = time.Duration(getIntFromJson(m["blocking_poll_min_ms"])) * time.Millisecond
+		}
+		if m["blocking_poll_max_ms"] != nil {
+			ctx.blockingPollMax = time.Duration(getIntFromJson(m["blocking_poll_max_ms"])) * time.Millisecond
+		}
+		// a zero delay would make blocked clients poll Aerospike in a loop
+		if ctx.blockingPollMin < time.Millisecond {
+			ctx.blockingPollMin = time.Millisecond
+		}
+		if ctx.blockingPollMax < ctx.blockingPollMin {
+			ctx.blockingPollMax = ctx.blockingPollMin
+		}
+
+		if m["hot_keys"] != nil {
+			size := getIntFromJson(m["hot_keys"])
+			sample := 10
+			if m["hot_keys_sample"] != nil {
+				sample = getIntFromJson(m["hot_keys_sample"])
+			}
+			decay := 60
+			if m["hot_keys_decay"] != nil {
+				decay = getIntFromJson(m["hot_keys_decay"])
+			}
+			bigKeyBytes := 1048576
+			if m["big_key_bytes"] != nil {
+				bigKeyBytes = getIntFromJson(m["big_key_bytes"])
+			}
+			bigKeyElements := 10000
+			if m["big_key_elements"] != nil {
+				bigKeyElements = getIntFromJson(m["big_key_elements"])
+			}
+			ctx.hotKeys = newHotKeys(set, size, sample, bigKeyBytes, bigKeyElements)
+			go ctx.hotKeys.decayLoop(time.Duration(decay) * time.Second)
+			log.Printf("%s: Tracking %d hot keys, sampling 1 command out of %d, big keys above %d bytes or %d elements", set, size, sample, bigKeyBytes, bigKeyElements)
+		}
 
 		if statsdConfig != nil {
 			log.Printf("%s: Sending stats to statsd %s", set, statsdConfig)
 			go statsd(statsdConfig.(string), &ctx)
 		}
 
-		if m["expanded_map"] != nil {
+		setHandlers := standardHandlers()
+		mapMode := setMapMode(m)
+		ctx.mapMode = mapMode
+		if mapMode == "expanded" || mapMode == "hybrid" {
 			if m["default_ttl"] != nil {
 				ctx.expandedMapDefaultTTL = getIntFromJson(m["default_ttl"])
 			} else {
 				ctx.expandedMapDefaultTTL = 3600 * 24 * 31
 			}
 			log.Printf("%s: Expanded map mode, ttl %d", set, ctx.expandedMapDefaultTTL)
+			ctx.expandedMapDelSyncLimit = 100
+			if m["del_sync_limit"] != nil {
+				ctx.expandedMapDelSyncLimit = getIntFromJson(m["del_sync_limit"])
+			}
+			ctx.expandedMapDirectoryLimit = 10000
+			if m["directory_limit"] != nil {
+				ctx.expandedMapDirectoryLimit = getIntFromJson(m["directory_limit"])
+			}
+			ctx.expandedMapHScanLimit = 100000
+			if m["hscan_query_limit"] != nil {
+				ctx.expandedMapHScanLimit = getIntFromJson(m["hscan_query_limit"])
+			}
+			queueSize := 10000
+			if m["del_queue_size"] != nil {
+				queueSize = getIntFromJson(m["del_queue_size"])
+			}
+			ctx.expandedMapDeleteQueue = make(chan expandedMapDeletion, queueSize)
+			go expandedMapDeleteWorker(&ctx)
 			if m["cache_size"] != nil {
-				size := getIntFromJson(m["cache_size"])
-				ctx.expandedMapCache = freecache.NewCache(size)
-				ctx.expandedMapCacheTTL = 600
+				ttl := 600
 				if m["cache_ttl"] != nil {
-					ctx.expandedMapCacheTTL = getIntFromJson(m["cache_ttl"])
+					ttl = getIntFromJson(m["cache_ttl"])
+				}
+				negativeTTL := 5
+				if m["negative_cache_ttl"] != nil {
+					negativeTTL = getIntFromJson(m["negative_cache_ttl"])
+				}
+				ctx.expandedMapCache = sharedExpandedMapCache(*ns, set, getIntFromJson(m["cache_size"]), ttl, negativeTTL)
+				if m["cache_peers"] != nil {
+					ctx.cachePeers = openCachePeers(m["cache_peers"].([]interface{}))
+					log.Printf("%s: Sending cache invalidations to %s", set, m["cache_peers"])
+				}
+				if m["cache_listen"] != nil {
+					go listenCacheInvalidations(&ctx, m["cache_listen"].(string))
 				}
-				log.Printf("%s: Using a cache of %d bytes, ttl %d", set, size, ctx.expandedMapCacheTTL)
-				go displayExpandedMapCacheStat(&ctx)
 			}
-			go handlePort(&ctx, l, writeBack(expandedMapHandlers(), m, &ctx))
-		} else {
-			go handlePort(&ctx, l, writeBack(standardHandlers(), m, &ctx))
+			handlers := expandedMapHandlers()
+			if mapMode == "hybrid" {
+				ctx.hybridSpillFields = 100
+				if m["spill_fields"] != nil {
+					ctx.hybridSpillFields = getIntFromJson(m["spill_fields"])
+				}
+				ctx.hybridSpillSize = 65536
+				if m["spill_size"] != nil {
+					ctx.hybridSpillSize = getIntFromJson(m["spill_size"])
+				}
+				log.Printf("%s: Hybrid map mode, spill after %d fields or %d bytes", set, ctx.hybridSpillFields, ctx.hybridSpillSize)
+				handlers = hybridMapHandlers()
+			} else if m["migrate_from_standard"] != nil {
+				log.Printf("%s: Migrating maps from the standard layout", set)
+				handlers = migrationHandlers(handlers)
+			}
+			setHandlers = handlers
+		} else if mapMode == "cdt" {
+			log.Printf("%s: CDT map mode", set)
+			setHandlers = cdtMapHandlers()
 		}
+		go handlePort(&ctx, l, nearCacheHandlers(coalesceHandlers(writeBack(setHandlers, m, &ctx), m, &ctx), m, &ctx))
 	}
 
 	wg.Wait()
@@ -257,6 +488,7 @@ func handleConnection(conn net.Conn, handlers map[string]handler, ctx *context)
 	errorPrefix := "[" + (*ctx).set + "] "
 
 	readingCtx := bufio.NewReader(conn)
+	client := &clientConn{Conn: conn, reader: readingCtx}
 	for {
 		args, err := parse(readingCtx)
 		if err != nil {
@@ -290,7 +522,7 @@ func handleConnection(conn net.Conn, handlers map[string]handler, ctx *context)
 			return handleError(err, ctx, conn)
 		}
 
-		execErr := handleCommand(conn, args, handlers, ctx, &multiMode, &multiCounter, multiBuffer)
+		execErr := handleCommand(client, args, handlers, ctx, &multiMode, &multiCounter, multiBuffer)
 		if execErr != nil {
 			writeErr(conn, errorPrefix, execErr.Error(), args)
 			atomic.AddUint32(&ctx.counterErr, 1)
@@ -351,7 +583,20 @@ func handleCommand(wf io.Writer, args [][]byte, handlers map[string]handler, ctx
 				}
 				targetWriter = multiBuffer
 			}
+			if ctx.hotKeys != nil && h.argsCount > 0 && !hotKeysExcludedCommands[cmd] {
+				ctx.hotKeys.record(args[0])
+				recorder := &replyRecorder{w: targetWriter}
+				defer ctx.hotKeys.recordReply(cmd, args[0], recorder)
+				targetWriter = recorder
+			}
 			if err := h.f(targetWriter, ctx, args); err != nil {
+				// a list operation on a string, or the reverse
+				if err == errWrongType || errResultCode(err) == ase.BIN_TYPE_ERROR {
+					return writeErrorReply(targetWriter, errWrongType.Error())
+				}
+				if err == errTooManyModifications {
+					return writeErrorReply(targetWriter, err.Error())
+				}
 				return fmt.Errorf("Aerospike error: '%s'", err)
 			}
 		} else {
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	as "github.com/aerospike/aerospike-client-go"
+)
+
+// SCAN and KEYS. Aerospike only returns the user key of records written with
+// send_key. The nodes are scanned one after the other, sorted by name. The
+// cursor holds the index of the node in its 8 high bits, and in the others
+// the position to start from in the node: the partition of the record, then
+// the first 44 bits of its digest. Each SCAN call scans the whole node, and
+// returns the count records following the cursor: walking a node of N keys
+// costs N / count node scans, so SCAN is only enabled with scan_min_count in
+// the set configuration, and a smaller COUNT is raised to it.
+// The client has no partition scans, so the cursor cannot be keyed on the
+// partition alone: while partitions migrate, a key may be returned twice or
+// missed, and when a node joins or leaves the cluster the indexes of the
+// following nodes shift, so a running SCAN may skip or repeat whole nodes.
+
+const errInvalidCursor = "ERR invalid cursor"
+const errKeysDisabled = "ERR KEYS is disabled on this set, use SCAN"
+const errScanDisabled = "ERR SCAN is disabled on this set, each call scans a whole Aerospike node"
+
+const scanNodeShift = 56
+const scanPositionMask = 1<<scanNodeShift - 1
+
+type scanEntry struct {
+	position uint64
+	key      string
+}
+
+// scanHeap is a max heap on position
+type scanHeap []scanEntry
+
+func (h scanHeap) Len() int            { return len(h) }
+func (h scanHeap) Less(i, j int) bool  { return h[i].position > h[j].position }
+func (h scanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scanHeap) Push(x interface{}) { *h = append(*h, x.(scanEntry)) }
+
+func (h *scanHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+type nodesByName []*as.Node
+
+func (a nodesByName) Len() int           { return len(a) }
+func (a nodesByName) Less(i, j int) bool { return a[i].GetName() < a[j].GetName() }
+func (a nodesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// scanPosition returns the position of a record in the scan order of its
+// node: its partition, then the first 44 bits of its digest
+func scanPosition(digest []byte) uint64 {
+	partition := binary.LittleEndian.Uint32(digest[0:4]) & 0xFFF
+	return uint64(partition)<<44 | binary.BigEndian.Uint64(digest[4:12])>>20
+}
+
+// scanLogicalKey returns the Redis key of a record. Field records of
+// expanded maps are skipped, and their main record is returned as the key of
+// the map, except in hybrid mode where the standard record is kept.
+func scanLogicalKey(ctx *context, k string) (string, bool) {
+	if !strings.HasPrefix(k, "composite_") {
+		return k, true
+	}
+	if ctx.mapMode == "expanded" && strings.HasSuffix(k, "_"+MAIN_SUFFIX) {
+		return k[len("composite_") : len(k)-len(MAIN_SUFFIX)-1], true
+	}
+	return "", false
+}
+
+// recordType returns the Redis type of a record
+func recordType(rec *as.Record) string {
+	if rec.Bins[SPILLED_BIN_NAME] != nil {
+		return "hash"
+	}
+	// lists and strings use the same bin
+	for _, v := range rec.Bins {
+		if _, ok := v.([]interface{}); ok {
+			return "list"
+		}
+	}
+	if len(rec.Bins) == 1 && rec.Bins[binName] != nil {
+		return "string"
+	}
+	return "hash"
+}
+
+// scanNodeKeys returns the count first keys of the node from the position
+// start, and true if there is no other key after them
+func scanNodeKeys(ctx *context, node *as.Node, start uint64, count int, match []byte, typ string) ([]scanEntry, bool, error) {
+	policy := as.NewScanPolicy()
+	policy.IncludeBinData = typ != ""
+	recordset, err := ctx.client.ScanNode(policy, node, ctx.ns, ctx.set)
+	if err != nil {
+		return nil, false, err
+	}
+	defer recordset.Close()
+	h := &scanHeap{}
+	found := 0
+	for res := range recordset.Results() {
+		if res.Err != nil {
+			return nil, false, res.Err
+		}
+		position := scanPosition(res.Record.Key.Digest())
+		if position < start || res.Record.Key.Value() == nil {
+			continue
+		}
+		k, ok := scanLogicalKey(ctx, res.Record.Key.Value().String())
+		if !ok {
+			continue
+		}
+		if match != nil && !stringMatch(match, []byte(k)) {
+			continue
+		}
+		if typ != "" && recordType(res.Record) != typ {
+			continue
+		}
+		found++
+		heap.Push(h, scanEntry{position, k})
+		if h.Len() > count {
+			heap.Pop(h)
+		}
+	}
+	entries := make([]scanEntry, h.Len())
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i] = heap.Pop(h).(scanEntry)
+	}
+	return entries, found <= count, nil
+}
+
+// scanKeys returns at most count keys from the cursor, and the next cursor
+func scanKeys(ctx *context, cursor uint64, count int, match []byte, typ string) ([]string, uint64, error) {
+	nodes := ctx.client.GetNodes()
+	sort.Sort(nodesByName(nodes))
+	keys := make([]string, 0)
+	i := int(cursor >> scanNodeShift)
+	start := cursor & scanPositionMask
+	for i < len(nodes) {
+		entries, complete, err := scanNodeKeys(ctx, nodes[i], start, count-len(keys), match, typ)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, e := range entries {
+			keys = append(keys, e.key)
+		}
+		if !complete {
+			last := entries[len(entries)-1].position
+			return keys, uint64(i)<<scanNodeShift | (last + 1), nil
+		}
+		i++
+		start = 0
+		if len(keys) >= count && i < len(nodes) {
+			return keys, uint64(i) << scanNodeShift, nil
+		}
+	}
+	return keys, 0, nil
+}
+
+// cmdSCAN is refused without scan_min_count in the set configuration. Each
+// call scans a whole node, a COUNT below scan_min_count is raised to it.
+func cmdSCAN(wf io.Writer, ctx *context, args [][]byte) error {
+	if ctx.scanMinCount <= 0 {
+		return writeErrorReply(wf, errScanDisabled)
+	}
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return writeErrorReply(wf, errInvalidCursor)
+	}
+	count := 10
+	var match []byte
+	typ := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			c, ok := parseInt(args[i+1])
+			if !ok || c < 1 {
+				return writeErrorReply(wf, "ERR syntax error")
+			}
+			count = int(c)
+		case "TYPE":
+			typ = strings.ToLower(string(args[i+1]))
+		default:
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+	}
+	if count < ctx.scanMinCount {
+		count = ctx.scanMinCount
+	}
+	keys, next, err := scanKeys(ctx, cursor, count, match, typ)
+	if err != nil {
+		return err
+	}
+	err = writeLine(wf, "*2")
+	if err != nil {
+		return err
+	}
+	err = writeByteArray(wf, []byte(strconv.FormatUint(next, 10)))
+	if err != nil {
+		return err
+	}
+	return writeHashKeys(wf, keys)
+}
+
+// cmdKEYS scans the whole set. It is refused without keys_limit in the set
+// configuration, and fails if it would return more than keys_limit keys.
+func cmdKEYS(wf io.Writer, ctx *context, args [][]byte) error {
+	if ctx.keysLimit <= 0 {
+		return writeErrorReply(wf, errKeysDisabled)
+	}
+	keys, next, err := scanKeys(ctx, 0, ctx.keysLimit+1, args[0], "")
+	if err != nil {
+		return err
+	}
+	if len(keys) > ctx.keysLimit || next != 0 {
+		return writeErrorReply(wf, "ERR KEYS would return more than "+strconv.Itoa(ctx.keysLimit)+" keys, use SCAN")
+	}
+	return writeHashKeys(wf, keys)
+}
+
+// stringMatch is the glob matching of Redis: *, ?, [abc], [^a], [a-z] and
+// \ to escape a char
+func stringMatch(pattern []byte, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if stringMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := bytes.IndexByte(pattern[1:], ']')
+			if end == -1 {
+				// not a class
+				if s[0] != '[' {
+					return false
+				}
+				s = s[1:]
+				break
+			}
+			class := pattern[1 : end+1]
+			not := len(class) > 0 && class[0] == '^'
+			if not {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if class[i] == '\\' && i+1 < len(class) {
+					i++
+					if class[i] == s[0] {
+						matched = true
+					}
+				} else if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := class[i], class[i+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						matched = true
+					}
+					i += 2
+				} else if class[i] == s[0] {
+					matched = true
+				}
+			}
+			if matched == not {
+				return false
+			}
+			pattern = pattern[end+1:]
+			s = s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
@@ -17,6 +17,32 @@ func udpSend(conn *net.UDPConn, s string) {
 	}
 }
 
+// batchStat measures the number of fields handled by a multi-field command
+type batchStat struct {
+	count uint32
+	total uint32
+	max   uint32
+}
+
+func newBatchStats() map[string]*batchStat {
+	return map[string]*batchStat{
+		"hmget":      {},
+		"hmset":      {},
+		"hmincrbyex": {},
+	}
+}
+
+func (b *batchStat) add(size int) {
+	atomic.AddUint32(&b.count, 1)
+	atomic.AddUint32(&b.total, uint32(size))
+	for {
+		max := atomic.LoadUint32(&b.max)
+		if uint32(size) <= max || atomic.CompareAndSwapUint32(&b.max, max, uint32(size)) {
+			return
+		}
+	}
+}
+
 func statsd(target string, ctx *context) {
 	ra, err := net.ResolveUDPAddr("udp", target)
 	if err != nil {
@@ -42,5 +68,26 @@ func statsd(target string, ctx *context) {
 		udpSend(conn, start+"ok:"+strconv.Itoa(int(ok/10))+"|g")
 		udpSend(conn, start+"err:"+strconv.Itoa(int(err/10))+"|g")
 		udpSend(conn, start+"conn:"+strconv.Itoa(int(c))+"|g")
+		for name, b := range ctx.batchStats {
+			count := atomic.SwapUint32(&b.count, 0)
+			total := atomic.SwapUint32(&b.total, 0)
+			max := atomic.SwapUint32(&b.max, 0)
+			if count > 0 {
+				udpSend(conn, start+"batch."+name+".avg:"+strconv.Itoa(int(total/count))+"|g")
+				udpSend(conn, start+"batch."+name+".max:"+strconv.Itoa(int(max))+"|g")
+			}
+		}
+		if ctx.expandedMapCache != nil {
+			ctx.expandedMapCache.sendStats(conn, start)
+		}
+		if ctx.nearCache != nil {
+			ctx.nearCache.sendStats(conn, start)
+		}
+		if ctx.coalescer != nil {
+			ctx.coalescer.sendStats(conn, start)
+		}
+		if ctx.hotKeys != nil {
+			ctx.hotKeys.sendStats(conn, start)
+		}
 	}
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	as "github.com/aerospike/aerospike-client-go"
+	ase "github.com/aerospike/aerospike-client-go/types"
+)
+
+// Max size of a string built by SETRANGE, like Redis
+const maxStringSize = 512 * 1024 * 1024
+
+// parseExpireOption converts the value of an EX / PX / EXAT / PXAT option
+// to a TTL in seconds. The TTL is negative or zero if an absolute time is in
+// the past.
+func parseExpireOption(option string, b []byte) (int, bool) {
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return expireTTL(option, v)
+}
+
+func getString(ctx *context, key *as.Key) (*as.Record, []byte, error) {
+	rec, err := ctx.client.Get(ctx.readPolicy, key, binName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec == nil || rec.Bins[binName] == nil {
+		return rec, nil, nil
+	}
+	buf, err := decodeValue(rec.Bins[binName])
+	return rec, buf, err
+}
+
+// updateString applies f to the current value of the string, and stores the
+// result if the record has not been modified in the meantime.
+func updateString(ctx *context, key *as.Key, f func([]byte) []byte) ([]byte, error) {
+	var result []byte
+	err := casRetry(func() error {
+		rec, current, err := getString(ctx, key)
+		if err != nil {
+			return err
+		}
+		result = f(current)
+		if result == nil {
+			return nil
+		}
+		return ctx.client.Put(fillWritePolicyCas(ctx, -1, rec), key, as.BinMap{binName: encode(ctx, result)})
+	})
+	return result, err
+}
+
+func cmdAPPEND(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if !ctx.backwardWriteCompat {
+		for i := 0; i < casMaxAttempts; i++ {
+			rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, -1, as.UPDATE_ONLY), key, as.AppendOp(as.NewBin(binName, args[1])), as.GetOpForBin(binName))
+			if err == nil {
+				buf, err := decodeValue(rec.Bins[binName])
+				if err != nil {
+					return err
+				}
+				return writeLine(wf, ":"+strconv.Itoa(len(buf)))
+			}
+			code := errResultCode(err)
+			if code == ase.BIN_TYPE_ERROR {
+				break
+			}
+			if code != ase.KEY_NOT_FOUND_ERROR {
+				return err
+			}
+			// a new key, whose value may be an integer
+			err = ctx.client.Put(fillWritePolicyEx(ctx, -1, true), key, as.BinMap{binName: encode(ctx, args[1])})
+			if err == nil {
+				return writeLine(wf, ":"+strconv.Itoa(len(args[1])))
+			}
+			if errResultCode(err) != ase.KEY_EXISTS_ERROR {
+				return err
+			}
+			// created in the meantime, append to it
+		}
+	}
+	// The value is stored as an integer, or as a legacy string, which
+	// Aerospike cannot append to: the new value is computed here, and only
+	// written if the record has not been modified since it has been read,
+	// so a concurrent write is not lost.
+	result, err := updateString(ctx, key, func(current []byte) []byte {
+		return append(append(make([]byte, 0, len(current)+len(args[1])), current...), args[1]...)
+	})
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(len(result)))
+}
+
+func cmdSTRLEN(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	_, buf, err := getString(ctx, key)
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(len(buf)))
+}
+
+func cmdGETRANGE(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	start, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return writeErrorReply(wf, "ERR value is not an integer or out of range")
+	}
+	end, err := strconv.Atoi(string(args[2]))
+	if err != nil {
+		return writeErrorReply(wf, "ERR value is not an integer or out of range")
+	}
+	_, buf, err := getString(ctx, key)
+	if err != nil {
+		return err
+	}
+	l := len(buf)
+	if start < 0 {
+		start += l
+	}
+	if end < 0 {
+		end += l
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= l {
+		end = l - 1
+	}
+	if l == 0 || start > end {
+		return writeByteArray(wf, []byte{})
+	}
+	return writeByteArray(wf, buf[start:end+1])
+}
+
+func cmdSETRANGE(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.Atoi(string(args[1]))
+	if err != nil || offset < 0 {
+		return writeErrorReply(wf, "ERR offset is out of range")
+	}
+	value := args[2]
+	if offset+len(value) > maxStringSize {
+		return writeErrorReply(wf, "ERR string exceeds maximum allowed size (512MB)")
+	}
+	// Aerospike cannot write in the middle of a string: the new value is
+	// computed here, and only written if the record has not been modified
+	// since it has been read, so a concurrent APPEND or SETRANGE is not lost.
+	// Under contention, it fails with errTooManyModifications after
+	// casMaxAttempts attempts.
+	length := 0
+	_, err = updateString(ctx, key, func(current []byte) []byte {
+		length = len(current)
+		if len(value) == 0 {
+			// nothing to write, do not create the key
+			return nil
+		}
+		var result []byte
+		if offset+len(value) > len(current) {
+			result = make([]byte, offset+len(value))
+			copy(result, current)
+		} else {
+			result = append(make([]byte, 0, len(current)), current...)
+		}
+		copy(result[offset:], value)
+		length = len(result)
+		return result
+	})
+	if err != nil {
+		return err
+	}
+	return writeLine(wf, ":"+strconv.Itoa(length))
+}
+
+func cmdGETSET(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	rec, err := ctx.client.Operate(ctx.writePolicy, key, as.GetOpForBin(binName), as.PutOp(as.NewBin(binName, encode(ctx, args[1]))))
+	if err != nil {
+		return err
+	}
+	return writeBin(wf, rec, binName, "$-1")
+}
+
+// getDel reads the string and removes it in a single operation.
+// Removing the last bin of a record removes the record.
+func getDel(wf io.Writer, ctx *context, key *as.Key) error {
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, -1, as.UPDATE_ONLY), key, as.GetOpForBin(binName), as.PutOp(as.NewBin(binName, nil)))
+	if err != nil {
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return writeLine(wf, "$-1")
+		}
+		return err
+	}
+	return writeBin(wf, rec, binName, "$-1")
+}
+
+func cmdGETDEL(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	return getDel(wf, ctx, key)
+}
+
+func cmdGETEX(wf io.Writer, ctx *context, args [][]byte) error {
+	key, err := buildKey(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		return get(wf, ctx, args[0], binName)
+	}
+	option := strings.ToUpper(string(args[1]))
+	ttl := ttlNeverExpire
+	switch option {
+	case "PERSIST":
+		if len(args) != 2 {
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+	case "EX", "PX", "EXAT", "PXAT":
+		if len(args) != 3 {
+			return writeErrorReply(wf, "ERR syntax error")
+		}
+		v, ok := parseExpireOption(option, args[2])
+		if !ok {
+			return writeErrorReply(wf, "ERR invalid expire time in 'getex' command")
+		}
+		if v <= 0 {
+			return getDel(wf, ctx, key)
+		}
+		ttl = v
+	default:
+		return writeErrorReply(wf, "ERR syntax error")
+	}
+	rec, err := ctx.client.Operate(fillWritePolicyAction(ctx, ttl, as.UPDATE_ONLY), key, as.TouchOp(), as.GetOpForBin(binName))
+	if err != nil {
+		if errResultCode(err) == ase.KEY_NOT_FOUND_ERROR {
+			return writeLine(wf, "$-1")
+		}
+		return err
+	}
+	return writeBin(wf, rec, binName, "$-1")
+}
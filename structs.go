@@ -2,9 +2,10 @@ package main
 
 import (
 	"io"
+	"net"
+	"time"
 
 	as "github.com/aerospike/aerospike-client-go"
-	"github.com/coocood/freecache"
 )
 
 type handler struct {
@@ -19,10 +20,34 @@ type context struct {
 	readPolicy            *as.BasePolicy
 	writePolicy           *as.WritePolicy
 	backwardWriteCompat   bool
+	legacyIntegerEncoding bool
+	hashFieldTTL          bool
+	sendKey               bool
+	mapMode               string
+	keysLimit             int
+	// SCAN is refused when 0, and its COUNT is at least scanMinCount
+	scanMinCount          int
 	counterOk             uint32
 	counterErr            uint32
 	gaugeConn             int32
 	expandedMapDefaultTTL int
-	expandedMapCache      *freecache.Cache
-	expandedMapCacheTTL   int
+	expandedMapCache      *expandedMapCache
+	// deleted maps, whose field records are removed in background
+	expandedMapDeleteQueue  chan expandedMapDeletion
+	expandedMapDelSyncLimit int
+	// max number of fields in the directory of a map
+	expandedMapDirectoryLimit int
+	// max number of fields read by HSCAN on a map without directory
+	expandedMapHScanLimit int
+	// thresholds of the hybrid map mode
+	hybridSpillFields int
+	hybridSpillSize   int
+	nearCache         *nearCache
+	coalescer         *coalescer
+	hotKeys           *hotKeys
+	batchStats        map[string]*batchStat
+	batchConcurrency  int
+	listWaiters       *listWaiters
+	blockingPollMin   time.Duration
+	blockingPollMax   time.Duration
 }
@@ -0,0 +1,61 @@
+<?php
+
+// Throughput of list commands on long lists.
+// Usage: php bench_list.php [list length] [iterations]
+// Run it against two aerodis builds to compare them.
+
+$length = isset($argv[1]) ? intval($argv[1]) : 10000;
+$iterations = isset($argv[2]) ? intval($argv[2]) : 2000;
+
+$r = new Redis();
+$r->connect('127.0.0.1', 6379);
+
+function bench($name, $iterations, $f) {
+  $start = microtime(true);
+  for($i = 0; $i < $iterations; $i ++) {
+    $f($i);
+  }
+  $delay = microtime(true) - $start;
+  printf("%-20s %8d ops in %6.2f s, %8.0f ops/s\n", $name, $iterations, $delay, $iterations / $delay);
+}
+
+$r->del('benchList');
+echo("Filling list with ".$length." elements\n");
+for($i = 0; $i < $length; $i ++) {
+  $r->rpush('benchList', 'value_'.$i);
+}
+
+bench('rpush', $iterations, function($i) use ($r) {
+  $r->rpush('benchList', 'value_'.$i);
+});
+
+bench('lpush', $iterations, function($i) use ($r) {
+  $r->lpush('benchList', 'value_'.$i);
+});
+
+bench('llen', $iterations, function($i) use ($r) {
+  $r->lSize('benchList');
+});
+
+bench('lrange 0 9', $iterations, function($i) use ($r) {
+  $r->lRange('benchList', 0, 9);
+});
+
+bench('lrange -10 -1', $iterations, function($i) use ($r) {
+  $r->lRange('benchList', -10, -1);
+});
+
+bench('rpop', $iterations, function($i) use ($r) {
+  $r->rpop('benchList');
+});
+
+bench('lpop', $iterations, function($i) use ($r) {
+  $r->lpop('benchList');
+});
+
+bench('ltrim', $iterations, function($i) use ($r, $length) {
+  $r->rpush('benchList', 'value_'.$i);
+  $r->ltrim('benchList', 0, $length - 1);
+});
+
+$r->del('benchList');
@@ -0,0 +1,49 @@
+<?php
+
+// Garbage collection of expanded maps.
+// php gc.php prepare: writes a map whose main record expires before its fields
+// php gc.php check: after gc, checks that the live maps are intact
+
+function dump($a) {
+  ob_start();
+  var_dump($a);
+  $aa = ob_get_contents();
+  ob_clean();
+  return trim($aa);
+}
+
+function compare($a, $b) {
+  if ($a !== $b) {
+    throw new Exception("Assert failed : <".dump($a)."> != <".dump($b).">");
+  }
+}
+
+function compare_map($a, $b) {
+  ksort($a);
+  ksort($b);
+  compare($a, $b);
+}
+
+$r = new Redis();
+$r->connect('127.0.0.1', 6379);
+
+if ($argv[1] == 'prepare') {
+  echo("Prepare gc\n");
+  $r->del('gcOrphan');
+  $r->del('gcAlive');
+  compare($r->hmSet('gcOrphan', array('a' => '1', 'b' => '2')), true);
+  compare($r->hmSet('gcAlive', array('a' => '1', 'b' => '2')), true);
+  // only the main record expires, the field records become orphans
+  compare($r->expire('gcOrphan', 1), true);
+  sleep(3);
+  compare($r->hGetAll('gcOrphan'), array());
+}
+
+if ($argv[1] == 'check') {
+  echo("Check gc\n");
+  compare_map($r->hGetAll('gcAlive'), array('a' => '1', 'b' => '2'));
+  compare($r->hGetAll('gcOrphan'), array());
+  compare($r->del('gcAlive'), 1);
+}
+
+echo("OK\n");
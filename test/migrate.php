@@ -0,0 +1,67 @@
+<?php
+
+// Migration from the standard to the expanded map layout.
+// php migrate.php prepare: writes maps, with aerodis using the standard layout
+// php migrate.php check: reads and writes them, with aerodis migrating maps
+// php migrate.php scanned: after migrate-maps, reads the maps it has migrated,
+// with aerodis using the expanded layout without fallback
+
+function dump($a) {
+  ob_start();
+  var_dump($a);
+  $aa = ob_get_contents();
+  ob_clean();
+  return trim($aa);
+}
+
+function compare($a, $b) {
+  if ($a !== $b) {
+    throw new Exception("Assert failed : <".dump($a)."> != <".dump($b).">");
+  }
+}
+
+function compare_map($a, $b) {
+  ksort($a);
+  ksort($b);
+  compare($a, $b);
+}
+
+$r = new Redis();
+$r->connect('127.0.0.1', 6379);
+
+if ($argv[1] == 'prepare') {
+  echo("Prepare migration\n");
+  $r->del('migrateRead');
+  $r->del('migrateWrite');
+  $r->del('migrateString');
+  $r->del('migrateScan');
+  compare($r->hmSet('migrateScan', array('a' => '1', 'b' => '2', 'c' => '3')), true);
+  compare($r->hmSet('migrateRead', array('a' => '1', 'b' => '2')), true);
+  compare($r->hmSet('migrateWrite', array('a' => '1', 'b' => '2')), true);
+  compare($r->set('migrateString', 'a'), true);
+} else if ($argv[1] == 'scanned') {
+  echo("Check migrate-maps\n");
+  compare_map($r->hGetAll('migrateScan'), array('a' => '1', 'b' => '2', 'c' => '3'));
+  compare($r->hLen('migrateScan'), 3);
+  compare($r->hSet('migrateScan', 'd', '4'), 1);
+  compare($r->del('migrateScan'), 1);
+  compare($r->hGetAll('migrateScan'), array());
+} else {
+  echo("Check migration\n");
+  compare_map($r->hGetAll('migrateRead'), array('a' => '1', 'b' => '2'));
+  compare($r->hGet('migrateRead', 'a'), '1');
+  compare($r->hLen('migrateRead'), 2);
+  compare($r->hSet('migrateWrite', 'veryveryveryveryveryverylongke', 'c'), 1);
+  compare_map($r->hGetAll('migrateWrite'), array('a' => '1', 'b' => '2', 'veryveryveryveryveryverylongke' => 'c'));
+  compare($r->hDel('migrateWrite', 'a'), 1);
+  compare_map($r->hGetAll('migrateWrite'), array('b' => '2', 'veryveryveryveryveryverylongke' => 'c'));
+  compare($r->hIncrBy('migrateRead', 'a', 1), 2);
+  compare_map($r->hGetAll('migrateRead'), array('a' => '2', 'b' => '2'));
+  compare($r->get('migrateString'), 'a');
+  compare($r->del('migrateRead'), 1);
+  compare($r->del('migrateWrite'), 1);
+  compare($r->del('migrateString'), 1);
+  compare($r->hGetAll('migrateRead'), array());
+}
+
+echo("OK\n");
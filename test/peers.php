@@ -0,0 +1,69 @@
+<?php
+
+// Cache invalidation between two aerodis instances serving the same set,
+// listening on 6379 and 6380, and sending each other their invalidations
+
+function dump($a) {
+  ob_start();
+  var_dump($a);
+  $aa = ob_get_contents();
+  ob_clean();
+  return trim($aa);
+}
+
+function compare($a, $b) {
+  if ($a !== $b) {
+    throw new Exception("Assert failed : <".dump($a)."> != <".dump($b).">");
+  }
+}
+
+function compare_map($a, $b) {
+  ksort($a);
+  ksort($b);
+  compare($a, $b);
+}
+
+// invalidations are sent asynchronously
+function wait_peers() {
+  usleep(200000);
+}
+
+$r1 = new Redis();
+$r1->connect('127.0.0.1', 6379);
+$r2 = new Redis();
+$r2->connect('127.0.0.1', 6380);
+
+echo("Recreated map\n");
+$r1->del('peerMap');
+wait_peers();
+compare($r1->hSet('peerMap', 'a', '1'), 1);
+wait_peers();
+compare($r2->hGet('peerMap', 'a'), '1');
+compare($r1->del('peerMap'), 1);
+compare($r1->hSet('peerMap', 'a', '2'), 1);
+wait_peers();
+compare($r2->hGet('peerMap', 'a'), '2');
+compare_map($r2->hGetAll('peerMap'), array('a' => '2'));
+
+echo("Deleted map\n");
+compare($r1->del('peerMap'), 1);
+wait_peers();
+compare($r2->hGetAll('peerMap'), array());
+compare($r2->hGet('peerMap', 'a'), false);
+
+echo("Created map\n");
+// cached as missing by the second instance
+compare($r2->hGet('peerMap', 'a'), false);
+compare($r1->hSet('peerMap', 'a', '3'), 1);
+wait_peers();
+compare($r2->hGet('peerMap', 'a'), '3');
+
+echo("Write to a recreated map\n");
+compare($r1->del('peerMap'), 1);
+compare($r1->hSet('peerMap', 'b', '1'), 1);
+// a write does not use a stale cache entry, even before the invalidation
+compare($r2->hSet('peerMap', 'c', '1'), 1);
+compare_map($r1->hGetAll('peerMap'), array('b' => '1', 'c' => '1'));
+compare($r1->del('peerMap'), 1);
+
+echo("OK\n");
@@ -5,7 +5,7 @@ pkill aerodis || true
 echo "Standard test"
 ../aerodis --config_file config.json &
 sleep 3
-php test.php
+SCAN=1 php test.php
 echo "TCP test"
 php tcp.php
 pkill aerodis || true
@@ -14,6 +14,73 @@ sleep 3
 echo "Expanded map test"
 ../aerodis --config_file config_expanded_map.json &
 sleep 3
-php test.php
+SCAN=1 php test.php
+pkill aerodis || true
+sleep 3
+
+echo "CDT map test"
+../aerodis --config_file config_cdt_map.json &
+sleep 3
+CDT_MAP=1 php test.php
+pkill aerodis || true
+sleep 3
+
+echo "Hybrid map test"
+../aerodis --config_file config_hybrid_map.json &
+sleep 3
+HYBRID_MAP=1 php test.php
+pkill aerodis || true
+sleep 3
+
+echo "Near cache test"
+../aerodis --config_file config_near_cache.json &
+sleep 3
+NEAR_CACHE=1 HOT_KEYS=1 php test.php
+pkill aerodis || true
+sleep 3
+
+echo "Migration test"
+../aerodis --config_file config.json &
+sleep 3
+php migrate.php prepare
+pkill aerodis || true
+sleep 3
+../aerodis --config_file config_migrate.json &
+sleep 3
+php migrate.php check
+pkill aerodis || true
+sleep 3
+../aerodis --config_file config_migrate.json migrate-maps --rate 0
+../aerodis --config_file config_expanded_map.json &
+sleep 3
+php migrate.php scanned
+pkill aerodis || true
+sleep 3
+
+echo "GC test"
+../aerodis --config_file config_expanded_map.json &
+sleep 3
+php gc.php prepare
+for i in 1 2; do
+  # a dry run reports the orphans without deleting them
+  ../aerodis --config_file config_expanded_map.json gc --dry_run --min_age 0 2> gc.log
+  grep -q "orphan fields for gcOrphan_" gc.log
+done
+../aerodis --config_file config_expanded_map.json gc --min_age 0 --rate 0
+../aerodis --config_file config_expanded_map.json gc --dry_run --min_age 0 2> gc.log
+if grep -q "orphan fields for gc" gc.log; then
+  echo "Orphans left after gc"
+  exit 1
+fi
+rm gc.log
+php gc.php check
+pkill aerodis || true
+sleep 3
+
+echo "Cache invalidation test"
+../aerodis --config_file config_peer1.json &
+../aerodis --config_file config_peer2.json &
+sleep 3
+php peers.php
 pkill aerodis || true
 sleep 3
@@ -58,9 +58,9 @@ func writeBack(handlers map[string]handler, config map[string]interface{}, ctx *
 		f := func(wf io.Writer, ctx *context, args [][]byte) error {
 			key := string(args[0])
 			field := string(args[1])
-			incr, err := strconv.Atoi(string(args[2]))
-			if err != nil {
-				return err
+			incr, ok := parseInt(args[2])
+			if !ok {
+				return writeErrorReply(wf, errNotInteger)
 			}
 			a[0] = key
 			a[1] = field
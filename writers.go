@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"io"
 	"log"
 	"strconv"
@@ -11,6 +12,10 @@ import (
 	as "github.com/aerospike/aerospike-client-go"
 )
 
+// errWrongType is returned by the handlers finding a value of another type:
+// it is sent as an error reply, and the connection is kept
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
 func writeErr(wf io.Writer, errorPrefix string, s string, args [][]byte) error {
 	one := ""
 	two := ""
@@ -24,6 +29,18 @@ func writeErr(wf io.Writer, errorPrefix string, s string, args [][]byte) error {
 	return write(wf, []byte("-ERR "+s+"\n"))
 }
 
+// writeErrorReply sends a Redis error, without closing the connection
+func writeErrorReply(wf io.Writer, s string) error {
+	return writeLine(wf, "-"+s)
+}
+
+func writeBool(wf io.Writer, b bool) error {
+	if b {
+		return writeLine(wf, ":1")
+	}
+	return writeLine(wf, ":0")
+}
+
 func writeByteArray(wf io.Writer, buf []byte) error {
 	err := write(wf, []byte("$"+strconv.Itoa(len(buf))+"\r\n"))
 	if err != nil {
@@ -42,31 +59,9 @@ func writeArray(wf io.Writer, array []interface{}) error {
 		return err
 	}
 	for _, e := range array {
-		// backward compat
-		switch e.(type) {
-		case string:
-			s := e.(string)
-			if strings.HasPrefix(s, "__64__") {
-				bytes, err := base64.StdEncoding.DecodeString(s[6:])
-				if err != nil {
-					return err
-				}
-				err = writeByteArray(wf, bytes)
-				if err != nil {
-					return err
-				}
-			} else {
-				err := writeByteArray(wf, []byte(s))
-				if err != nil {
-					return err
-				}
-			}
-		default:
-			// end of backward compat
-			err := writeByteArray(wf, e.([]byte))
-			if err != nil {
-				return err
-			}
+		err := writeValue(wf, e)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
@@ -93,27 +88,42 @@ func writeLine(wf io.Writer, s string) error {
 	// return wf([]byte(s + "\r\n"))
 }
 
-func writeValue(wf io.Writer, x interface{}) error {
+func decodeValue(x interface{}) ([]byte, error) {
 	switch x.(type) {
 	case int:
-		return writeByteArray(wf, []byte(strconv.Itoa(x.(int))))
+		return []byte(strconv.Itoa(x.(int))), nil
+	case float64:
+		return []byte(formatFloat(x.(float64))), nil
 	// backward compat
 	case string:
 		s := x.(string)
 		if strings.HasPrefix(s, "__64__") {
-			bytes, err := base64.StdEncoding.DecodeString(s[6:])
-			if err != nil {
-				return err
-			}
-			return writeByteArray(wf, bytes)
+			return base64.StdEncoding.DecodeString(s[6:])
 		}
-		return writeByteArray(wf, []byte(s))
+		return []byte(s), nil
 	// end of backward compat
 	default:
-		return writeByteArray(wf, x.([]byte))
+		buf, ok := x.([]byte)
+		if !ok {
+			return nil, errWrongType
+		}
+		return buf, nil
 	}
 }
 
+// formatFloat formats a float like Redis: no exponent, no trailing zeros
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func writeValue(wf io.Writer, x interface{}) error {
+	buf, err := decodeValue(x)
+	if err != nil {
+		return err
+	}
+	return writeByteArray(wf, buf)
+}
+
 func writeBin(wf io.Writer, rec *as.Record, binName string, nilValue string) error {
 	if rec == nil {
 		return writeLine(wf, nilValue)
@@ -134,7 +144,7 @@ func writeBinInt(wf io.Writer, rec *as.Record, binName string) error {
 	if x == nil {
 		return writeLine(wf, nilValue)
 	}
-	return writeLine(wf, ":"+strconv.Itoa(x.(int)))
+	return writeLine(wf, ":"+strconv.FormatInt(int64(x.(int)), 10))
 }
 
 func writeArrayBin(wf io.Writer, res []*as.Record, binName string, keyBinName string) error {
@@ -161,11 +171,21 @@ func writeArrayBin(wf io.Writer, res []*as.Record, binName string, keyBinName st
 	return nil
 }
 
+// encode converts a value to the Aerospike value to store. A value is stored
+// as an integer only if it is the canonical decimal form of this integer, so
+// values like "007" or "+5" are read back unchanged.
 func encode(ctx *context, buf []byte) interface{} {
-	if len(buf) < 10 {
-		x, err := strconv.Atoi(string(buf))
-		if err == nil {
-			return x
+	if ctx.legacyIntegerEncoding {
+		if len(buf) < 10 {
+			x, err := strconv.Atoi(string(buf))
+			if err == nil {
+				return x
+			}
+		}
+	} else {
+		x, err := strconv.ParseInt(string(buf), 10, 64)
+		if err == nil && strconv.FormatInt(x, 10) == string(buf) {
+			return int(x)
 		}
 	}
 	if !ctx.backwardWriteCompat {